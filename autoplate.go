@@ -2,17 +2,66 @@ package main
 
 import (
 	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"container/heap"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
 	"encoding/xml"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"maps"
+	"math"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	_ "net/http/pprof"
+	"net/textproto"
+	"net/url"
 	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"runtime/pprof"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
+	"github.com/bodgit/sevenzip"
 	"github.com/jlaffaye/ftp"
+	"github.com/nats-io/nats.go"
+	"github.com/parquet-go/parquet-go"
+	"github.com/segmentio/kafka-go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/exp/mmap"
+	"golang.org/x/time/rate"
+	"gopkg.in/yaml.v3"
 )
 
 // XML structure matching the Danish vehicle registration format
@@ -26,269 +75,6867 @@ type StatistikSamling struct {
 }
 
 type Statistik struct {
+	KoeretoejIdent                  string                          `xml:"KoeretoejIdent"`
+	KoeretoejArtNavn                string                          `xml:"KoeretoejArtNavn"` // vehicle type, e.g. Personbil
 	RegistreringNummerNummer        string                          `xml:"RegistreringNummerNummer"`
 	KoeretoejOplysningGrundStruktur KoeretoejOplysningGrundStruktur `xml:"KoeretoejOplysningGrundStruktur"`
+	KoeretoejRegistreringStatusDato string                          `xml:"KoeretoejRegistreringStatusDato"`
+	SynResultatStruktur             SynResultatStruktur             `xml:"SynResultatStruktur"`
+}
+
+// SynResultatStruktur is the result of the vehicle's last inspection (syn). The feed
+// has no date for the next inspection.
+type SynResultatStruktur struct {
+	SynResultatSynsDato string `xml:"SynResultatSynsDato"`
 }
 
 type KoeretoejOplysningGrundStruktur struct {
-	KoeretoejBetegnelseStruktur KoeretoejBetegnelseStruktur `xml:"KoeretoejBetegnelseStruktur"`
+	KoeretoejOplysningFoersteRegistreringDato string                           `xml:"KoeretoejOplysningFoersteRegistreringDato"`
+	KoeretoejOplysningStelNummer              string                           `xml:"KoeretoejOplysningStelNummer"`
+	KoeretoejOplysningKoereklarVaegtMinimum   string                           `xml:"KoeretoejOplysningKoereklarVaegtMinimum"` // kerb weight in kg
+	KoeretoejOplysningTekniskTotalVaegt       string                           `xml:"KoeretoejOplysningTekniskTotalVaegt"`     // technically permissible maximum mass in kg
+	KoeretoejBetegnelseStruktur               KoeretoejBetegnelseStruktur      `xml:"KoeretoejBetegnelseStruktur"`
+	KoeretoejMiljoeOplysningStruktur          KoeretoejMiljoeOplysningStruktur `xml:"KoeretoejMiljoeOplysningStruktur"`
+	KoeretoejMotorStruktur                    KoeretoejMotorStruktur           `xml:"KoeretoejMotorStruktur"`
+}
+
+// KoeretoejMiljoeOplysningStruktur holds the environmental data of the vehicle, of
+// which only the CO2 emissions (g/km) are used. Many records leave them out.
+type KoeretoejMiljoeOplysningStruktur struct {
+	KoeretoejMiljoeOplysningCO2Udslip string `xml:"KoeretoejMiljoeOplysningCO2Udslip"`
+}
+
+type KoeretoejBetegnelseStruktur struct {
+	KoeretoejMaerkeTypeNavn string `xml:"KoeretoejMaerkeTypeNavn"`
+	Model                   Model  `xml:"Model"`
+}
+
+type Model struct {
+	KoeretoejModelTypeNavn string `xml:"KoeretoejModelTypeNavn"`
+}
+
+type KoeretoejMotorStruktur struct {
+	DrivmiddelStruktur []DrivmiddelStruktur `xml:"KoeretoejDrivmiddelSamlingStruktur>KoeretoejDrivmiddelSamling>DrivmiddelStruktur"`
+}
+
+type DrivmiddelStruktur struct {
+	DrivkraftTypeStruktur           DrivkraftTypeStruktur `xml:"DrivkraftTypeStruktur"`
+	KoeretoejMotorDrivmiddelPrimaer bool                  `xml:"KoeretoejMotorDrivmiddelPrimaer"`
+}
+
+type DrivkraftTypeStruktur struct {
+	DrivkraftTypeNavn string `xml:"DrivkraftTypeNavn"`
+}
+
+// Config holds the command line options used throughout the pipeline. The yaml keys
+// match the flag names, so a -config file can set any option a flag can.
+type Config struct {
+	File              string            `yaml:"file"`
+	Range             string            `yaml:"range"`
+	rangeLo, rangeHi  string            // bounds of the parsed Range
+	Fuzzy             string            `yaml:"fuzzy"`
+	fuzzyPlate        string            // plate of the parsed Fuzzy
+	fuzzyDist         int               // distance of the parsed Fuzzy
+	Regex             string            `yaml:"regex"`     // list plates matching this regular expression
+	CSV               string            `yaml:"csv"`       // export all plates to this CSV file
+	CSVDelim          string            `yaml:"csv-delim"` // field delimiter of the CSV export, a single character
+	csvComma          rune              // CSVDelim as a rune
+	CSVQuoteAll       bool              `yaml:"csv-quote-all"`      // quote every field of the CSV export, not only those that need it
+	Append            bool              `yaml:"append"`             // append to existing export files instead of overwriting them
+	MaxMemory         ByteSize          `yaml:"max-memory"`         // soft limit on heap usage while parsing, 0 means unlimited
+	FTPDebug          bool              `yaml:"ftp-debug"`          // log the raw FTP command/response dialog to stderr
+	FieldList         string            `yaml:"fields"`             // comma-separated export columns, resolved into Fields
+	Fields            []Field           `yaml:"-"`                  // columns written by the exports, in order
+	Sort              string            `yaml:"sort"`               // display order: plate or timestamp
+	ManifestIn        string            `yaml:"manifest-in"`        // file listing the archives to process, one per line
+	Key               string            `yaml:"key"`                // vehicle field used as the unique key: plate, vin or regid
+	PlatesOnly        bool              `yaml:"plates-only"`        // only extract the plate of each record, skipping the full decode
+	Snapshot          string            `yaml:"snapshot"`           // gzipped gob file used to skip the import when it is up to date
+	MaxBandwidth      Bandwidth         `yaml:"max-bandwidth"`      // download rate limit, 0 means unlimited
+	OutputDir         string            `yaml:"output-dir"`         // directory all generated files are written under
+	MappingFile       string            `yaml:"mapping"`            // JSON file mapping XML element paths to fields
+	Mapping           map[string]string `yaml:"-"`                  // loaded from MappingFile, nil to use the compiled Statistik structure
+	PprofAddr         string            `yaml:"pprof"`              // address to serve net/http/pprof on
+	CPUProfile        string            `yaml:"cpuprofile"`         // file to write a CPU profile of the run to
+	MemProfile        string            `yaml:"memprofile"`         // file to write a heap profile to once parsing is done
+	Strict            bool              `yaml:"strict"`             // fail on truncated XML instead of keeping the records read before the cut
+	Host              string            `yaml:"host"`               // comma-separated FTP servers, tried in order
+	HashPlates        bool              `yaml:"hash-plates"`        // store and export salted hashes instead of the plates
+	HashSalt          string            `yaml:"hash-salt"`          // secret key for HashPlates
+	Baseline          string            `yaml:"baseline"`           // JSON lines file with the summary of previous runs
+	BaselineRuns      int               `yaml:"baseline-runs"`      // number of previous runs the baseline is averaged over
+	BaselineTolerance float64           `yaml:"baseline-tolerance"` // allowed deviation from the baseline, in percent
+	BaselineFail      bool              `yaml:"baseline-fail"`      // exit with exitOutsideBaseline instead of warning
+	MaxFileSize       ByteSize          `yaml:"max-file-size"`      // largest file that is downloaded, 0 means unlimited
+	Parquet           string            `yaml:"parquet"`            // export all plates to this Parquet file
+	Merge             string            `yaml:"merge"`              // how a record for an existing key is stored: last, newest or fill
+	merged            int               // records merged into an existing one, see Merge
+	OTLPEndpoint      string            `yaml:"otlp-endpoint"` // OTLP/HTTP collector the trace of the run is exported to
+	ctx               context.Context   // carries the run span, nil when tracing has not been set up
+	InspectionDue     string            `yaml:"inspection-due"` // list vehicles last inspected before this date (YYYY-MM-DD)
+	Compact           bool              `yaml:"compact"`        // only keep the -fields columns (and those a query needs) in memory
+	compactFields     map[string]bool   // fields kept with Compact, see compactFieldSet
+	compactDropped    int64             // bytes of field data dropped with Compact
+	DateLayouts       string            `yaml:"date-layouts"`         // comma-separated Go time layouts for dates in the feed, tried in order
+	TimeSeries        string            `yaml:"timeseries"`           // export first registrations per bucket to this CSV or JSON file
+	Bucket            string            `yaml:"bucket"`               // time series bucket: day, week or month
+	InMemory          ByteSize          `yaml:"in-memory"`            // archives up to this size are downloaded into memory instead of a temp file
+	Latest            int               `yaml:"latest"`               // list the N most recently registered vehicles
+	FTPMode           string            `yaml:"ftp-mode"`             // how data connections are opened: epsv or passive
+	FTPType           string            `yaml:"ftp-type"`             // transfer type of the downloads: binary or ascii
+	TransferTimeout   time.Duration     `yaml:"transfer-timeout"`     // deadline of each FTP data transfer, 0 means none
+	ExportFlush       int               `yaml:"export-flush"`         // rows written to an export before it is flushed to disk
+	PlateVINMap       string            `yaml:"plate-vin-map"`        // export plate,vin rows to this CSV file
+	ReportInvalid     string            `yaml:"report-invalid"`       // export the plates that fail validatePlate to this CSV file
+	Histograms        string            `yaml:"histograms"`           // export the vehicles per make, fuel type and year to this CSV or JSON file
+	KAnonymity        int               `yaml:"k-anonymity"`          // histogram buckets with fewer vehicles are merged into "other"
+	ConnectTimeout    time.Duration     `yaml:"connect-timeout"`      // limit for connecting and logging in to the FTP server
+	IdleTimeout       time.Duration     `yaml:"idle-timeout"`         // a transfer without data for this long is abandoned, 0 means never
+	IncludeEmpty      bool              `yaml:"include-empty-plates"` // keep records without a value for the key under a placeholder key
+	emptyKeys         int               // records kept under a placeholder key, see IncludeEmpty
+	Reconcile         bool              `yaml:"reconcile"` // keep plates of the previous snapshot that are missing from the feed, marked inactive
+	User              string            `yaml:"user"`      // FTP user name, or a vault:path#field reference to it
+	Pass              string            `yaml:"pass"`      // FTP password, or a vault:path#field reference to it
+	Repeated          int               `yaml:"repeated"`  // report the N plates that occur most often in the feed, before duplicates are merged
+	plateCounts       map[string]int    // occurrences of each plate in the feed, nil unless Repeated is set
+	Pattern           string            `yaml:"pattern"`        // only consider FTP files matching this wildcard pattern, filtered by the server if it can
+	NewerThan         string            `yaml:"newer-than"`     // only consider FTP files modified on or after this date (YYYY-MM-DD)
+	Newest            int               `yaml:"newest"`         // process the N newest FTP archives together, oldest first
+	ExportedSince     string            `yaml:"exported-since"` // only export the records changed on or after this date (YYYY-MM-DD)
+	exportedSince     time.Time         // parsed ExportedSince, zero if not set
+	newerThan         time.Time         // parsed NewerThan, zero if not set
+	inspectionDue     time.Time         // parsed InspectionDue, zero if not set
+	ExpectMake        makeExpectations  `yaml:"expect-make"`   // expected number of vehicles per make, checked after parsing
+	Sink              string            `yaml:"sink"`          // kafka:// or nats:// URL records are published to as JSON while parsing
+	SinkNewOnly       bool              `yaml:"sink-new-only"` // only publish keys not seen before in the run or the previous snapshot
+	sinkKnown         map[string]bool   // keys of the previous snapshot, not published again with SinkNewOnly
+	onInsert          insertFunc        // called after every plate stored, nil unless a -sink is open
+	Replay            string            `yaml:"replay"`           // snapshot whose records are run through the outputs instead of importing
+	PrefixStats       int               `yaml:"prefix-stats"`     // report the number of plates per leading letter prefix of this length
+	CopyBufferSize    ByteSize          `yaml:"copy-buffer-size"` // downloads are written in chunks of this size, 0 writes whatever each network read returns
+	Changes           string            `yaml:"changes"`          // JSON lines file of the -fields that changed since the previous snapshot, per plate
+	Sample            float64           `yaml:"sample"`           // fraction of the records that is processed, the others are skipped at random
+	Seed              uint64            `yaml:"seed"`             // seed of the -sample choice, 0 picks a random one
+	sampler           *rand.Rand        // decides which records are sampled, nil unless Sample is below 1
+	sampled, scanned  int               // records kept by -sample and records seen in total
+	StatsOnly         bool              `yaml:"stats-only"` // print a JSON report of the feed instead of storing the plates
+	stats             *feedStats        // report of a StatsOnly run, nil otherwise
+	ProfileFields     bool              `yaml:"profile-fields"` // report the share of records with each field set
+	profile           *fieldProfile     // the counts of ProfileFields
+	MMap              bool              `yaml:"mmap"`             // read zip archives through a memory mapping instead of file reads
+	SampleDisplay     string            `yaml:"sample-display"`   // which plates the summary shows: head, tail or random
+	KeepTmp           bool              `yaml:"keep-tmp"`         // keep FTP downloads and parse them again instead of downloading them while unchanged
+	RunLog            string            `yaml:"run-log"`          // append a JSON line about each run to this file
+	RunLogMaxSize     ByteSize          `yaml:"run-log-max-size"` // the run log is rotated to .1 when it would grow beyond this size, 0 means never
+	source            string            // what the plates were read from, for the run log
+	sourceTime        time.Time         // modification time of source, zero if unknown
+	CO2ByMake         bool              `yaml:"co2-by-make"`        // report the average CO2 emissions and kerb weight per make
+	ParallelDownloads int               `yaml:"parallel-downloads"` // with -newest, download up to this many archives at once, each over its own connection
+	Category          string            `yaml:"category"`           // only keep the vehicles of this EU vehicle category, e.g. M1
+	otherCategories   int               // records skipped by -category
+	unknownTypes      map[string]int    // vehicles per type that is not in vehicleCategories
+	badDates          int               // dates parseDate could not parse during the run
+	MaxEntries        int               `yaml:"max-entries"` // only process the first N XML entries of each archive, 0 for all
+	REPL              bool              `yaml:"repl"`        // read query commands from stdin once the plates are loaded
+	PlatesTxt         string            `yaml:"plates-txt"`  // export the sorted, distinct plates to this text file, one per line
+	ConfigFile        string            `yaml:"-"`           // YAML file the other options are read from, so it cannot be set in the file
+	List              bool              `yaml:"list"`        // list the files on the FTP server and exit
+	Explain           bool              `yaml:"explain"`     // print the effective options and the plan of the run and exit
+	Bytes             string            `yaml:"bytes"`       // how sizes are printed: human or raw
+}
+
+// loadConfigFile decodes a YAML config file into cfg, rejecting keys that do not
+// match any option
+func loadConfigFile(path string, cfg *Config) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open config file: %w", err)
+	}
+	defer file.Close()
+
+	decoder := yaml.NewDecoder(file)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(cfg); err != nil && err != io.EOF {
+		return fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// ByteSize is a size in bytes that can be given with a unit suffix, e.g. 512MB or 4GB
+type ByteSize int64
+
+var byteUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"TB", 1 << 40},
+	{"GB", 1 << 30},
+	{"MB", 1 << 20},
+	{"KB", 1 << 10},
+	{"B", 1},
+}
+
+// rawBytes makes humanizeBytes print plain byte counts, for downstream parsers
+// that do not want to deal with units. It is set with -bytes raw.
+var rawBytes bool
+
+// humanizeBytes formats a size for output, scaled to the largest unit that fits,
+// e.g. 4.72 MB, or as a plain byte count if rawBytes is set
+func humanizeBytes(n int64) string {
+	if rawBytes {
+		return strconv.FormatInt(n, 10) + " bytes"
+	}
+	for _, unit := range byteUnits {
+		if unit.size > 1 && n >= unit.size {
+			return fmt.Sprintf("%.2f %s", float64(n)/float64(unit.size), unit.suffix)
+		}
+	}
+	return strconv.FormatInt(n, 10) + " B"
+}
+
+func (b ByteSize) String() string {
+	for _, unit := range byteUnits {
+		if b != 0 && int64(b)%unit.size == 0 {
+			return strconv.FormatInt(int64(b)/unit.size, 10) + unit.suffix
+		}
+	}
+	return "0"
+}
+
+// UnmarshalText lets config files give sizes with a unit suffix as well
+func (b *ByteSize) UnmarshalText(text []byte) error {
+	return b.Set(string(text))
+}
+
+func (b *ByteSize) Set(value string) error {
+	size, err := parseByteSize(value)
+	if err != nil {
+		return err
+	}
+	*b = size
+	return nil
+}
+
+// parseByteSize parses a plain byte count or a number with a B/KB/MB/GB/TB suffix
+func parseByteSize(value string) (ByteSize, error) {
+	v := strings.ToUpper(strings.TrimSpace(value))
+	multiplier := int64(1)
+	for _, unit := range byteUnits {
+		if strings.HasSuffix(v, unit.suffix) {
+			v = strings.TrimSpace(strings.TrimSuffix(v, unit.suffix))
+			multiplier = unit.size
+			break
+		}
+	}
+
+	n, err := strconv.ParseFloat(v, 64)
+	if err != nil || n < 0 || math.IsNaN(n) {
+		return 0, fmt.Errorf("invalid size %q (expected e.g. 500MB or 4GB)", value)
+	}
+	// MaxInt64 rounds up to 2^63 as a float, which is too large itself
+	if n*float64(multiplier) >= math.MaxInt64 {
+		return 0, fmt.Errorf("size %q is too large", value)
+	}
+	return ByteSize(n * float64(multiplier)), nil
+}
+
+// errMemoryLimit is returned when the parsed plates exceed the -max-memory soft limit
+var errMemoryLimit = errors.New("memory limit exceeded")
+
+// errFeedMismatch is returned when too many records fail to decode, see
+// maxDecodeFailureRate. Like errMemoryLimit it fails the run instead of keeping
+// the records parsed so far.
+var errFeedMismatch = errors.New("too many records failed to decode")
+
+// memoryCheckInterval is how many plates are parsed between samples of the heap size
+const memoryCheckInterval = 10000
+
+// checkMemory samples the heap and fails when it has grown past the soft limit
+func checkMemory(limit ByteSize, count int) error {
+	if limit <= 0 {
+		return nil
+	}
+
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	if m.HeapAlloc > uint64(limit) {
+		return fmt.Errorf("%w: heap is %s after %d plates, limit is %s; "+
+			"raise -max-memory or run on a machine with more memory", errMemoryLimit, humanizeBytes(int64(m.HeapAlloc)), count, limit)
+	}
+	return nil
+}
+
+// useOutputDir creates a subdirectory of OutputDir named after the run's start time
+// and moves all relative output paths under it. Per-run exports and a copy of the log
+// go in the run directory, while state shared across runs (the snapshot) stays at
+// the top level of OutputDir.
+func (cfg *Config) useOutputDir(start time.Time) (string, error) {
+	runDir := cfg.runDir(start)
+	if err := os.MkdirAll(runDir, 0o755); err != nil {
+		return "", err
+	}
+	cfg.placeOutputs(runDir)
+
+	logFile, err := os.OpenFile(filepath.Join(runDir, "autoplate.log"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return "", err
+	}
+	log.SetOutput(io.MultiWriter(os.Stderr, logFile))
+
+	return runDir, nil
+}
+
+// runDir returns the run directory of a run started at start
+func (cfg *Config) runDir(start time.Time) string {
+	return filepath.Join(cfg.OutputDir, start.Format("20060102-150405"))
+}
+
+// placeOutputs moves the relative output paths under runDir, or under OutputDir
+// for the files shared across runs
+func (cfg *Config) placeOutputs(runDir string) {
+	under := func(dir string, path *string) {
+		if *path != "" && !filepath.IsAbs(*path) {
+			*path = filepath.Join(dir, *path)
+		}
+	}
+	under(runDir, &cfg.CSV)
+	under(runDir, &cfg.Parquet)
+	under(runDir, &cfg.TimeSeries)
+	under(runDir, &cfg.PlateVINMap)
+	under(runDir, &cfg.PlatesTxt)
+	under(runDir, &cfg.Histograms)
+	under(runDir, &cfg.ReportInvalid)
+	under(runDir, &cfg.Changes)
+	under(cfg.OutputDir, &cfg.Snapshot)
+	under(cfg.OutputDir, &cfg.Baseline)
+	under(cfg.OutputDir, &cfg.RunLog)
+}
+
+// explainRun prints the options that differ from their defaults, after the config
+// file and the command line are merged, and the steps a run with them would take.
+// Nothing is connected to or written. Output paths whose directory does not exist
+// are flagged, as the run would only fail on them once the import is done.
+func explainRun(cfg *Config, runDir string) {
+	fmt.Println("=== Options ===")
+	changed := 0
+	flag.VisitAll(func(f *flag.Flag) {
+		if f.Name == "explain" || f.Value.String() == f.DefValue {
+			return
+		}
+		value := f.Value.String()
+		if f.Name == "hash-salt" || (f.Name == "pass" && !strings.HasPrefix(value, "vault:")) {
+			value = "(set)"
+		}
+		fmt.Printf("  -%s %s\n", f.Name, value)
+		changed++
+	})
+	if changed == 0 {
+		fmt.Println("  (all defaults)")
+	}
+
+	fmt.Println("\n=== Plan ===")
+	step := 0
+	plan := func(format string, args ...any) {
+		step++
+		fmt.Printf("%d. %s\n", step, fmt.Sprintf(format, args...))
+	}
+	// problems are printed below the step they concern
+	problem := func(format string, args ...any) {
+		fmt.Printf("   ⚠ %s\n", fmt.Sprintf(format, args...))
+	}
+	checkDir := func(path string) {
+		// The output directories are created by the run itself
+		dir := filepath.Dir(path)
+		if dir == runDir || (cfg.OutputDir != "" && dir == filepath.Clean(cfg.OutputDir)) {
+			return
+		}
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			problem("directory %s does not exist", dir)
+		}
+	}
+
+	if runDir != "" {
+		plan("Create the run directory %s with a copy of the log", runDir)
+	}
+	if cfg.RunLog != "" {
+		if cfg.RunLogMaxSize > 0 {
+			plan("Append a record of the run to %s, rotating it at %s", cfg.RunLog, cfg.RunLogMaxSize)
+		} else {
+			plan("Append a record of the run to %s", cfg.RunLog)
+		}
+		checkDir(cfg.RunLog)
+	}
+
+	ftpSource := fmt.Sprintf("FTP server %s, directory %s (%s mode, %s transfers, connect timeout %v, idle timeout %v)",
+		strings.Join(parseHosts(cfg.Host), ", then "), ftpDir, cfg.FTPMode, cfg.FTPType, cfg.ConnectTimeout, cfg.IdleTimeout)
+
+	switch {
+	case cfg.Replay != "":
+		plan("Replay the records of the snapshot %s, whatever it was built from", cfg.Replay)
+		if _, err := os.Stat(cfg.Replay); err != nil {
+			problem("%v", err)
+		}
+	case cfg.ManifestIn != "":
+		names, err := readManifest(cfg.ManifestIn)
+		if err != nil {
+			plan("Process the files listed in %s", cfg.ManifestIn)
+			problem("%v", err)
+			break
+		}
+		local := 0
+		for _, name := range names {
+			if _, err := os.Stat(name); err == nil {
+				local++
+			}
+		}
+		plan("Process the %d files listed in %s: %d local, %d from the %s", len(names), cfg.ManifestIn, local, len(names)-local, ftpSource)
+	case cfg.File == "-":
+		plan("Read a zip, 7z or (gzipped) XML file from stdin")
+	case cfg.File != "":
+		plan("Read %s", cfg.File)
+		if _, err := os.Stat(cfg.File); err != nil {
+			problem("%v", err)
+		}
+	default:
+		if cfg.Newest > 1 {
+			plan("Download the %d newest .zip or .7z files from the %s, and process them oldest first", cfg.Newest, ftpSource)
+			if cfg.ParallelDownloads > 1 {
+				plan("Download up to %d of them at once, each over its own connection, before processing them", cfg.ParallelDownloads)
+			}
+		} else {
+			plan("Download the newest .zip or .7z file from the %s", ftpSource)
+		}
+		if cfg.Pattern != "" {
+			plan("Only consider files matching %s", cfg.Pattern)
+		}
+		if cfg.NewerThan != "" {
+			plan("Only consider files modified on or after %s", cfg.NewerThan)
+		}
+		if cfg.MaxBandwidth > 0 {
+			plan("Limit the download to %s", cfg.MaxBandwidth)
+		}
+		if cfg.MaxFileSize > 0 {
+			plan("Refuse files larger than %s", cfg.MaxFileSize)
+		}
+	}
+	if cfg.KeepTmp && cfg.Replay == "" && cfg.File == "" {
+		plan("Keep the downloads in %s, and parse a kept one instead of downloading it again if it is unchanged", keptDir(cfg))
+	}
+
+	if cfg.Snapshot != "" {
+		plan("Load the plates from the snapshot %s if it is up to date, otherwise import and save it", cfg.Snapshot)
+		checkDir(cfg.Snapshot)
+		if cfg.Reconcile {
+			plan("Keep the plates of the previous snapshot that are missing from the feed, marked as inactive")
+		}
+		if cfg.Changes != "" {
+			plan("Write the changes of %s since the previous snapshot to %s", cfg.FieldList, cfg.Changes)
+			checkDir(cfg.Changes)
+		}
+	}
+
+	// A replay stores the records as they are in the snapshot
+	if cfg.Replay == "" {
+		parsing := "all fields"
+		switch {
+		case cfg.PlatesOnly:
+			parsing = "only the plates"
+		case cfg.MappingFile != "":
+			parsing = "the fields mapped in " + cfg.MappingFile
+		}
+		plan("Parse %s, keyed on %s, merging records with the same key by -merge %s", parsing, cfg.Key, cfg.Merge)
+		if cfg.Compact {
+			plan("Keep only %s in memory", strings.Join(cfg.compactFieldNames(), ", "))
+		}
+		if cfg.HashPlates {
+			plan("Replace the plates with salted hashes")
+		}
+		if cfg.IncludeEmpty {
+			plan("Keep records without a %s under placeholder keys", cfg.Key)
+		}
+		if cfg.Category != "" {
+			plan("Only keep the vehicles of EU vehicle category %s", cfg.Category)
+		}
+		if cfg.MaxEntries > 0 {
+			plan("Only process the first %d XML entries of each archive", cfg.MaxEntries)
+		}
+		if cfg.Sample < 1 {
+			plan("Only process a random %g%% of the records, with -seed %d", cfg.Sample*100, cfg.Seed)
+		}
+		if cfg.MaxMemory > 0 {
+			plan("Stop if the heap grows beyond %s", cfg.MaxMemory)
+		}
+		if cfg.ProfileFields {
+			plan("Report the percentage of records with each field set")
+		}
+	}
+
+	if cfg.StatsOnly {
+		plan("Print a JSON report of the records to stdout, keeping only the keys in memory, and exit")
+		return
+	}
+
+	if cfg.Baseline != "" {
+		action := "warn"
+		if cfg.BaselineFail {
+			action = "exit with code 4"
+		}
+		plan("Compare the plate count to the last %d runs in %s and %s if it is off by more than %g%%",
+			cfg.BaselineRuns, cfg.Baseline, action, cfg.BaselineTolerance)
+		checkDir(cfg.Baseline)
+	}
+	if cfg.Sink != "" {
+		which := "every parsed record"
+		if cfg.SinkNewOnly {
+			which = "the records with keys not in the previous snapshot"
+		}
+		if u, _, _, err := parseSinkURL(cfg.Sink); err == nil {
+			plan("Publish %s as JSON to %s while parsing", which, u.Redacted())
+		}
+	}
+	for _, expectation := range cfg.ExpectMake {
+		plan("Check that there are %s %s vehicles and exit with code %d if not", expectation.describe(), expectation.Make, exitExpectationFailed)
+	}
+
+	switch cfg.SampleDisplay {
+	case "tail":
+		plan("Display the last %d plates in %s order", displayLimit, cfg.Sort)
+	case "random":
+		plan("Display %d random plates in %s order", displayLimit, cfg.Sort)
+	default:
+		plan("Display the first %d plates in %s order", displayLimit, cfg.Sort)
+	}
+
+	exports := []struct{ name, path string }{
+		{"the " + cfg.FieldList + " fields as CSV", cfg.CSV},
+		{"all fields as Parquet", cfg.Parquet},
+		{"the first registrations per " + cfg.Bucket, cfg.TimeSeries},
+		{"the plate to VIN map", cfg.PlateVINMap},
+		{"the distinct plates as text", cfg.PlatesTxt},
+		{"the invalid and implausible plates", cfg.ReportInvalid},
+		{fmt.Sprintf("the histograms, merging buckets below %d vehicles,", cfg.KAnonymity), cfg.Histograms},
+	}
+	for _, export := range exports {
+		if export.path == "" {
+			continue
+		}
+		if export.path == cfg.CSV && cfg.Append {
+			plan("Append %s to %s", export.name, export.path)
+		} else {
+			plan("Export %s to %s", export.name, export.path)
+		}
+		checkDir(export.path)
+	}
+	if cfg.ExportedSince != "" && (cfg.CSV != "" || cfg.Parquet != "" || cfg.PlateVINMap != "" || cfg.PlatesTxt != "" || cfg.ReportInvalid != "") {
+		plan("Only export the records first registered or with a status change on or after %s", cfg.ExportedSince)
+	}
+
+	queries := []struct{ flag, value string }{
+		{"range", cfg.Range},
+		{"fuzzy", cfg.Fuzzy},
+		{"regex", cfg.Regex},
+		{"inspection-due", cfg.InspectionDue},
+	}
+	if cfg.Latest > 0 {
+		queries = append(queries, struct{ flag, value string }{"latest", strconv.Itoa(cfg.Latest)})
+	}
+	if cfg.PrefixStats > 0 {
+		queries = append(queries, struct{ flag, value string }{"prefix-stats", strconv.Itoa(cfg.PrefixStats)})
+	}
+	for _, query := range queries {
+		if query.value != "" {
+			plan("Query -%s %s", query.flag, query.value)
+		}
+	}
+	if cfg.CO2ByMake {
+		plan("Report the average CO2 emissions and kerb weight per make")
+	}
+	if cfg.REPL {
+		plan("Read query commands from stdin until quit or the end of the input")
+	}
+}
+
+// startCPUProfile starts writing a CPU profile to path, returning the function that stops it
+func startCPUProfile(path string) (func(), error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := pprof.StartCPUProfile(file); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return func() {
+		pprof.StopCPUProfile()
+		file.Close()
+	}, nil
+}
+
+// tracer creates the spans of the pipeline stages
+var tracer = otel.Tracer("autoplate")
+
+// startTracing exports spans to an OTLP/HTTP collector. The endpoint is a URL, or
+// host:port for a collector without TLS, and the standard /v1/traces path is used
+// unless the URL has a path. The returned function flushes the spans that have not
+// been exported yet.
+func startTracing(endpoint string) (func(), error) {
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "http://" + endpoint
+	}
+	endpointURL, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid endpoint: %w", err)
+	}
+	if endpointURL.Path == "" || endpointURL.Path == "/" {
+		endpointURL.Path = "/v1/traces"
+	}
+
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(endpointURL.String()))
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "autoplate"))),
+	)
+	otel.SetTracerProvider(provider)
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := provider.Shutdown(ctx); err != nil {
+			log.Printf("Warning: failed to export trace: %v", err)
+		}
+	}, nil
+}
+
+// startSpan starts the span of a pipeline stage as a child of the run span
+func (cfg *Config) startSpan(name string, attrs ...attribute.KeyValue) trace.Span {
+	ctx := cfg.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	_, span := tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+	return span
+}
+
+// endSpan marks span as failed if err is set, and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// writeHeapProfile writes a profile of the live heap to path
+func writeHeapProfile(path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	runtime.GC() // get up-to-date statistics of what is still in use
+	if err := pprof.WriteHeapProfile(file); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// emptyKeyFormat is the placeholder key of the n-th record without a key value,
+// kept with -include-empty-plates. The parentheses cannot occur in a plate, VIN or
+// registry id, so it cannot collide with a real key.
+const emptyKeyFormat = "(empty %d)"
+
+// keyOf returns the value of the configured key field for v
+func (cfg *Config) keyOf(v *Vehicle) string {
+	if keyOf, ok := keyFields[cfg.Key]; ok {
+		return keyOf(v)
+	}
+	return v.Plate
+}
+
+// insertFunc is called after every plate stored, isNew if the key was not in the map yet
+type insertFunc func(key string, vehicle Vehicle, isNew bool)
+
+// Vehicle is the record stored for each license plate
+type Vehicle struct {
+	Plate    string
+	VIN      string
+	RegID    string // the registry's internal vehicle id (KoeretoejIdent)
+	Make     string
+	Model    string
+	FuelType string
+	Type     string // the registry's vehicle type (KoeretoejArtNavn), e.g. Personbil
+	Category string // EU vehicle category derived from Type, e.g. M1, or unclassified
+
+	FirstRegistration time.Time // zero when the feed has no (valid) first registration date
+	StatusTime        time.Time // last change of the registration status, zero when unknown
+	LastInspection    time.Time // zero for vehicles that have not been inspected yet, like new ones
+	KerbWeight        int       // kerb weight in kg, zero when unknown
+	CO2               float64   // CO2 emissions in g/km, zero when unknown
+	Inactive          time.Time `profile:"-"` // first run the plate was missing from the feed with -reconcile, zero while it is in the feed
+}
+
+func newVehicle(stat *Statistik, cfg *Config) Vehicle {
+	betegnelse := &stat.KoeretoejOplysningGrundStruktur.KoeretoejBetegnelseStruktur
+	return Vehicle{
+		Plate:    stat.RegistreringNummerNummer,
+		VIN:      stat.KoeretoejOplysningGrundStruktur.KoeretoejOplysningStelNummer,
+		RegID:    stat.KoeretoejIdent,
+		Make:     betegnelse.KoeretoejMaerkeTypeNavn,
+		Model:    betegnelse.Model.KoeretoejModelTypeNavn,
+		FuelType: primaryFuelType(stat.KoeretoejOplysningGrundStruktur.KoeretoejMotorStruktur.DrivmiddelStruktur),
+		Type:     stat.KoeretoejArtNavn,
+		Category: vehicleCategory(stat.KoeretoejArtNavn, int(parseNumber(stat.KoeretoejOplysningGrundStruktur.KoeretoejOplysningTekniskTotalVaegt))),
+
+		FirstRegistration: parseDate(stat.KoeretoejOplysningGrundStruktur.KoeretoejOplysningFoersteRegistreringDato, cfg),
+		StatusTime:        parseDate(stat.KoeretoejRegistreringStatusDato, cfg),
+		LastInspection:    parseDate(stat.SynResultatStruktur.SynResultatSynsDato, cfg),
+		KerbWeight:        int(math.Round(parseNumber(stat.KoeretoejOplysningGrundStruktur.KoeretoejOplysningKoereklarVaegtMinimum))),
+		CO2:               parseNumber(stat.KoeretoejOplysningGrundStruktur.KoeretoejMiljoeOplysningStruktur.KoeretoejMiljoeOplysningCO2Udslip),
+	}
+}
+
+// parseNumber parses a measurement from the feed, which may be written with a
+// decimal comma (119,5) as well as a point. Empty, malformed and negative values
+// are returned as zero, which the aggregations treat as unknown.
+func parseNumber(value string) float64 {
+	n, err := strconv.ParseFloat(strings.Replace(strings.TrimSpace(value), ",", ".", 1), 64)
+	if err != nil || n < 0 || math.IsNaN(n) || math.IsInf(n, 0) {
+		return 0
+	}
+	return n
+}
+
+// formatNumber formats a measurement for the exports, empty when it is zero
+func formatNumber(n float64) string {
+	if n == 0 {
+		return ""
+	}
+	return strconv.FormatFloat(n, 'f', -1, 64)
+}
+
+// unclassified is the category of vehicles whose type has no EU vehicle category
+const unclassified = "unclassified"
+
+// categoryClass is an EU vehicle category with the highest technically permissible
+// maximum mass in kg of the vehicles in it, 0 for no limit
+type categoryClass struct {
+	category string
+	maxMass  int
+}
+
+// vehicleCategories maps the registry's vehicle types, in lower case, to their EU
+// vehicle categories. Types that span several categories list them by increasing
+// mass limit. Types without an EU category, like motor implements, map to none.
+var vehicleCategories = map[string][]categoryClass{
+	"personbil":      {{"M1", 0}},
+	"bus":            {{"M2", 5000}, {"M3", 0}},
+	"varebil":        {{"N1", 0}},
+	"lastbil":        {{"N2", 12000}, {"N3", 0}},
+	"motorcykel":     {{"L3e", 0}},
+	"stor knallert":  {{"L1e", 0}},
+	"lille knallert": {{"L1e", 0}},
+	"traktor":        {{"T", 0}},
+	"påhængsvogn":    {{"O1", 750}, {"O2", 3500}, {"O3", 10000}, {"O4", 0}},
+	"sættevogn":      {{"O1", 750}, {"O2", 3500}, {"O3", 10000}, {"O4", 0}},
+	"campingvogn":    {{"O1", 750}, {"O2", 3500}, {"O3", 10000}, {"O4", 0}},
+	"motorredskab":   nil,
+	"påhængsredskab": nil,
+}
+
+// vehicleCategory returns the EU vehicle category of a vehicle of the given type and
+// technically permissible maximum mass in kg, where 0 means the mass is not known.
+// Vehicles without a type, of a type without a category, or of a type spanning
+// several categories without a mass are unclassified. For a type that is not in
+// vehicleCategories an empty string is returned, see countUnknownType.
+func vehicleCategory(vehicleType string, maxMass int) string {
+	name := strings.ToLower(strings.TrimSpace(vehicleType))
+	if name == "" {
+		return unclassified
+	}
+	classes, ok := vehicleCategories[name]
+	if !ok {
+		return ""
+	}
+
+	switch {
+	case len(classes) == 0:
+		return unclassified
+	case len(classes) == 1:
+		return classes[0].category
+	case maxMass <= 0:
+		return unclassified
+	}
+	for _, class := range classes {
+		if class.maxMass == 0 || maxMass <= class.maxMass {
+			return class.category
+		}
+	}
+	return unclassified
+}
+
+// countUnknownType counts a vehicle whose type vehicleCategory does not know in
+// cfg.unknownTypes, logging each type the first time it is seen, and makes the
+// vehicle unclassified
+func countUnknownType(vehicle *Vehicle, cfg *Config) {
+	if cfg.unknownTypes == nil {
+		cfg.unknownTypes = make(map[string]int)
+	}
+	if cfg.unknownTypes[vehicle.Type] == 0 {
+		log.Printf("Warning: unknown vehicle type %q, its vehicles are %s", vehicle.Type, unclassified)
+	}
+	cfg.unknownTypes[vehicle.Type]++
+	vehicle.Category = unclassified
+}
+
+// canonicalCategory returns the EU vehicle category of vehicleCategories, or
+// unclassified, that name is a spelling of in any case
+func canonicalCategory(name string) (string, error) {
+	known := []string{unclassified}
+	for _, classes := range vehicleCategories {
+		for _, class := range classes {
+			known = append(known, class.category)
+		}
+	}
+	slices.Sort(known)
+	known = slices.Compact(known)
+	for _, category := range known {
+		if strings.EqualFold(category, name) {
+			return category, nil
+		}
+	}
+	return "", fmt.Errorf("unknown category %q (known categories: %s)", name, strings.Join(known, ", "))
+}
+
+// dateLayouts are the layouts tried by parseFlexibleDate, in order. The current
+// feed uses xs:date values like 2007-11-28+01:00 and timestamps like
+// 2020-12-23T09:21:18.000+01:00, older files also plain and day-first dates.
+// They can be replaced with -date-layouts.
+var dateLayouts = []string{"2006-01-02Z07:00", time.RFC3339, "2006-01-02", "02-01-2006"}
+
+// parseFlexibleDate parses value with the first of dateLayouts that matches it
+func parseFlexibleDate(value string) (time.Time, error) {
+	for _, layout := range dateLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("date %q does not match any of the layouts %s", value, strings.Join(dateLayouts, ", "))
+}
+
+// maxDateWarnings caps how many unparseable dates are logged, the rest are only counted
+const maxDateWarnings = 10
+
+// parseDate parses a date or timestamp from the feed, returning the zero time for
+// empty or malformed values. Malformed values are counted in cfg.badDates and
+// logged, up to maxDateWarnings.
+func parseDate(value string, cfg *Config) time.Time {
+	if value == "" {
+		return time.Time{}
+	}
+	t, err := parseFlexibleDate(value)
+	if err != nil {
+		cfg.badDates++
+		if cfg.badDates <= maxDateWarnings {
+			log.Printf("Warning: %v", err)
+		}
+		if cfg.badDates == maxDateWarnings {
+			log.Printf("Warning: not logging further unparseable dates")
+		}
+		return time.Time{}
+	}
+	return t
+}
+
+// primaryFuelType returns the fuel marked as primary, or the first one listed (hybrids list several)
+func primaryFuelType(fuels []DrivmiddelStruktur) string {
+	for _, fuel := range fuels {
+		if fuel.KoeretoejMotorDrivmiddelPrimaer {
+			return fuel.DrivkraftTypeStruktur.DrivkraftTypeNavn
+		}
+	}
+	if len(fuels) > 0 {
+		return fuels[0].DrivkraftTypeStruktur.DrivkraftTypeNavn
+	}
+	return ""
+}
+
+// keyFields are the vehicle fields that can be used as the unique key of the plates map.
+// A later record with the same key replaces the earlier one:
+//   - plate: plates are reused over time, so only the last vehicle listed with a plate is kept
+//   - vin:   a vehicle that was re-registered keeps only its last registration
+//   - regid: the registry's own id, one per vehicle registration, so collisions are rare
+var keyFields = map[string]func(v *Vehicle) string{
+	"plate": func(v *Vehicle) string { return v.Plate },
+	"vin":   func(v *Vehicle) string { return v.VIN },
+	"regid": func(v *Vehicle) string { return v.RegID },
+}
+
+// MakeModel returns the make and model as a single display name
+func (v Vehicle) MakeModel() string {
+	return strings.TrimSpace(v.Make + " " + v.Model)
+}
+
+// Formats used by the default progress printing, given the percentage, current and
+// total bytes and the average speed in MB/s
+const (
+	downloadProgressFormat = "\rDownloading: %d%% (%s / %s, %s/s)"
+	parseProgressFormat    = "  Parsing: %d%% (%s / %s, %s/s)\n"
+	bufferProgressFormat   = "\rBuffering stdin: %d%% (%s / %s, %s/s)"
+)
+
+// ProgressReader wraps an io.Reader and reports progress
+type ProgressReader struct {
+	reader     io.Reader
+	total      int64
+	current    int64
+	lastPrint  int64
+	started    time.Time
+	format     string // format for the default printing, downloadProgressFormat if empty
+	onProgress func(current, total int64)
+}
+
+func (pr *ProgressReader) Read(p []byte) (int, error) {
+	if pr.started.IsZero() {
+		pr.started = time.Now()
+	}
+
+	n, err := pr.reader.Read(p)
+	pr.current += int64(n)
+
+	if pr.onProgress != nil {
+		pr.onProgress(pr.current, pr.total)
+	} else {
+		pr.printProgress(pr.current, pr.total)
+	}
+
+	return n, err
+}
+
+// printProgress is the default progress callback, printing whole percentages to the terminal
+func (pr *ProgressReader) printProgress(current, total int64) {
+	if total > 0 {
+		percentDone := (current * 100) / total
+		if percentDone > pr.lastPrint {
+			pr.lastPrint = percentDone
+			format := pr.format
+			if format == "" {
+				format = downloadProgressFormat
+			}
+			fmt.Printf(format, percentDone, humanizeBytes(current), humanizeBytes(total), humanizeBytes(int64(pr.speed())))
+		}
+	}
+}
+
+// speed returns the average number of bytes read per second since the first read
+func (pr *ProgressReader) speed() float64 {
+	elapsed := time.Since(pr.started).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(pr.current) / elapsed
+}
+
+const (
+	// boardRedrawInterval is how often a progressBoard redraws its lines on a terminal
+	boardRedrawInterval = 100 * time.Millisecond
+
+	// boardStep is the step in percent at which a progressBoard prints progress
+	// lines when the output is not a terminal
+	boardStep = 10
+)
+
+// progressBoard shows the progress of several downloads running at once, which a
+// single \r line of a ProgressReader cannot. On a terminal it keeps one line per
+// active transfer, and a total line when there are several, at the bottom of the
+// output and redraws them in place. Anywhere else it only prints a line whenever a
+// transfer passes another boardStep percent. Its methods hold a mutex while they
+// write, and while it is in use the log is written through it as well, so the
+// lines of concurrent transfers and messages never run into each other.
+type progressBoard struct {
+	mu        sync.Mutex
+	out       io.Writer
+	log       io.Writer // where log output written to the board goes
+	tty       bool
+	width     int // columns of the terminal, lines are cut to fit so redraws stay aligned
+	transfers []*boardTransfer
+	drawn     int // number of progress lines currently at the bottom of the terminal
+	lastDraw  time.Time
+}
+
+// boardTransfer is one download on a progressBoard
+type boardTransfer struct {
+	name    string
+	current int64
+	total   int64
+	started time.Time
+	printed int64 // last percentage printed when the output is not a terminal
+}
+
+// newProgressBoard returns a board writing to out, with multi-line rendering only if
+// out is a terminal. The terminal width is taken from COLUMNS, 80 if unset.
+func newProgressBoard(out *os.File, log io.Writer) *progressBoard {
+	info, err := out.Stat()
+	width, _ := strconv.Atoi(os.Getenv("COLUMNS"))
+	if width <= 0 {
+		width = 80
+	}
+	return &progressBoard{
+		out:   out,
+		log:   log,
+		tty:   err == nil && info.Mode()&os.ModeCharDevice != 0,
+		width: width,
+	}
+}
+
+// add starts showing a transfer of total bytes, 0 if unknown
+func (b *progressBoard) add(name string, total int64) *boardTransfer {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	t := &boardTransfer{name: name, total: total, started: time.Now()}
+	b.transfers = append(b.transfers, t)
+	b.redraw(true)
+	return t
+}
+
+// update records the progress of t, as a ProgressReader's onProgress
+func (b *progressBoard) update(t *boardTransfer, current, total int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	t.current, t.total = current, total
+	if b.tty {
+		b.redraw(false)
+		return
+	}
+	if total > 0 {
+		percent := current * 100 / total
+		if step := percent - percent%boardStep; step > t.printed {
+			t.printed = step
+			fmt.Fprintln(b.out, b.line(t))
+		}
+	}
+}
+
+// remove stops showing t, once its transfer has ended
+func (b *progressBoard) remove(t *boardTransfer) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.transfers = slices.DeleteFunc(b.transfers, func(other *boardTransfer) bool { return other == t })
+	b.redraw(true)
+}
+
+// printf prints a message above the progress lines
+func (b *progressBoard) printf(format string, args ...any) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.clear()
+	fmt.Fprintf(b.out, format, args...)
+	b.redraw(true)
+}
+
+// Write writes log output above the progress lines, so the board can be set as the
+// output of the log while it is in use
+func (b *progressBoard) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.clear()
+	n, err := b.log.Write(p)
+	b.redraw(true)
+	return n, err
+}
+
+// line formats the progress of t like the single-line download progress
+func (b *progressBoard) line(t *boardTransfer) string {
+	speed := 0.0
+	if elapsed := time.Since(t.started).Seconds(); elapsed > 0 {
+		speed = float64(t.current) / elapsed
+	}
+	if t.total <= 0 {
+		return fmt.Sprintf("  %s: %s, %s/s", t.name, humanizeBytes(t.current), humanizeBytes(int64(speed)))
+	}
+	return fmt.Sprintf("  %s: %d%% (%s / %s, %s/s)", t.name, t.current*100/t.total,
+		humanizeBytes(t.current), humanizeBytes(t.total), humanizeBytes(int64(speed)))
+}
+
+// clear removes the progress lines from the terminal, leaving the cursor where the
+// first of them was. The caller holds the mutex.
+func (b *progressBoard) clear() {
+	if b.tty && b.drawn > 0 {
+		fmt.Fprintf(b.out, "\x1b[%dA\r\x1b[J", b.drawn)
+		b.drawn = 0
+	}
+}
+
+// redraw draws the progress lines again on a terminal, or only if the last redraw
+// was at least boardRedrawInterval ago unless force is set. The caller holds the mutex.
+func (b *progressBoard) redraw(force bool) {
+	if !b.tty || (!force && time.Since(b.lastDraw) < boardRedrawInterval) {
+		return
+	}
+	b.clear()
+	b.lastDraw = time.Now()
+
+	lines := make([]string, 0, len(b.transfers)+1)
+	var current, total int64
+	var speed float64
+	for _, t := range b.transfers {
+		lines = append(lines, b.line(t))
+		current += t.current
+		total += t.total
+		if elapsed := time.Since(t.started).Seconds(); elapsed > 0 {
+			speed += float64(t.current) / elapsed
+		}
+	}
+	if len(b.transfers) > 1 {
+		lines = append(lines, fmt.Sprintf("  Total of %d downloads: %s / %s, %s/s", len(b.transfers),
+			humanizeBytes(current), humanizeBytes(total), humanizeBytes(int64(speed))))
+	}
+	for _, line := range lines {
+		if runes := []rune(line); len(runes) >= b.width {
+			line = string(runes[:b.width-1])
+		}
+		fmt.Fprintln(b.out, line)
+	}
+	b.drawn = len(lines)
+}
+
+// Bandwidth is a transfer rate in bytes per second, given like a ByteSize with an
+// optional /s suffix, e.g. 5MB/s
+type Bandwidth ByteSize
+
+func (b Bandwidth) String() string {
+	if b == 0 {
+		return "0"
+	}
+	return ByteSize(b).String() + "/s"
+}
+
+func (b *Bandwidth) Set(value string) error {
+	size, err := parseByteSize(strings.TrimSuffix(strings.TrimSpace(value), "/s"))
+	if err != nil {
+		return err
+	}
+	*b = Bandwidth(size)
+	return nil
+}
+
+func (b *Bandwidth) UnmarshalText(text []byte) error {
+	return b.Set(string(text))
+}
+
+// throttledReader limits the rate at which bytes are read from the wrapped reader
+type throttledReader struct {
+	reader  io.Reader
+	limiter *rate.Limiter
+}
+
+func newThrottledReader(reader io.Reader, limit Bandwidth) *throttledReader {
+	// Allow bursts of a tenth of a second worth of data so reads stay reasonably large
+	burst := max(int(limit)/10, 1)
+	return &throttledReader{
+		reader:  reader,
+		limiter: rate.NewLimiter(rate.Limit(limit), burst),
+	}
+}
+
+func (tr *throttledReader) Read(p []byte) (int, error) {
+	if burst := tr.limiter.Burst(); len(p) > burst {
+		p = p[:burst]
+	}
+
+	n, err := tr.reader.Read(p)
+	if n > 0 {
+		if waitErr := tr.limiter.WaitN(context.Background(), n); waitErr != nil && err == nil {
+			err = waitErr
+		}
+	}
+	return n, err
+}
+
+// recordProgressInterval is the number of plates between two progress lines
+const recordProgressInterval = 10000
+
+// newRecordProgress returns the default record callback, printing every
+// recordProgressInterval plates with the throughput since the previous line
+func newRecordProgress() func(count int) {
+	last := time.Now()
+	return func(count int) {
+		if count%recordProgressInterval != 0 {
+			return
+		}
+		now := time.Now()
+		fmt.Printf("  Processed %d plates... (%s)\n", count, recordRate(recordProgressInterval, now.Sub(last)))
+		last = now
+	}
+}
+
+// recordRate formats the throughput of count records parsed in elapsed
+func recordRate(count int, elapsed time.Duration) string {
+	return fmt.Sprintf("%.0f records/s", float64(count)/max(elapsed.Seconds(), 1e-3))
+}
+
+func main() {
+	// Options set with flag.Var take their default from here
+	cfg := &Config{CopyBufferSize: 1 << 20, RunLogMaxSize: 10 << 20}
+	flag.StringVar(&cfg.File, "file", "", "Path to local XML or ZIP file, or - to read it from stdin (if not provided, downloads from FTP)")
+	flag.StringVar(&cfg.Range, "range", "", "List plates between two values (inclusive), given as lo,hi")
+	flag.StringVar(&cfg.Fuzzy, "fuzzy", "", "List plates within an edit distance of a plate, given as plate,dist")
+	flag.StringVar(&cfg.Regex, "regex", "", "List plates matching a regular expression, e.g. 777 (full scan)")
+	flag.StringVar(&cfg.CSV, "csv", "", "Export all plates to a CSV file")
+	flag.StringVar(&cfg.CSVDelim, "csv-delim", ",", "Field delimiter of the -csv export, a single character such as ; for Danish locale tools")
+	flag.BoolVar(&cfg.CSVQuoteAll, "csv-quote-all", false, "Quote every field of the -csv export, not only those containing the delimiter, quotes or line breaks")
+	flag.BoolVar(&cfg.Append, "append", false, "Append to existing export files, separating runs with a comment line")
+	flag.Var(&cfg.MaxMemory, "max-memory", "Soft limit on memory used while parsing, e.g. 4GB (0 means unlimited)")
+	flag.BoolVar(&cfg.FTPDebug, "ftp-debug", false, "Log the raw FTP protocol dialog to stderr (noisy)")
+	flag.StringVar(&cfg.FieldList, "fields", strings.Join(fieldNames(vehicleFields), ","), "Comma-separated list of columns to export")
+	flag.StringVar(&cfg.Sort, "sort", "plate", "Order of the displayed plates: plate (ascending), natural (letters, then number) or timestamp (newest registration first)")
+	flag.StringVar(&cfg.ManifestIn, "manifest-in", "", "Process every local path or FTP file name listed in this file (one per line) into one dataset")
+	flag.StringVar(&cfg.Key, "key", "plate", "Field used as the unique key: plate, vin or regid (records without it are skipped)")
+	flag.BoolVar(&cfg.PlatesOnly, "plates-only", false, "Only extract the plates, skipping the decode of all other fields (much faster)")
+	flag.StringVar(&cfg.ConfigFile, "config", "", "YAML file with options, keyed by flag name (flags given on the command line take precedence)")
+	flag.StringVar(&cfg.Snapshot, "snapshot", "", "Save the parsed plates to this file, and load them from it instead of importing when it is up to date")
+	flag.Var(&cfg.MaxBandwidth, "max-bandwidth", "Limit the download speed, e.g. 5MB/s (0 means unlimited)")
+	flag.StringVar(&cfg.OutputDir, "output-dir", "", "Write generated files under this directory: exports and a log in a per-run subdirectory, the snapshot at the top level")
+	flag.StringVar(&cfg.MappingFile, "mapping", "", "JSON file mapping XML element paths (below Statistik) to field names, used instead of the built-in structure")
+	flag.StringVar(&cfg.PprofAddr, "pprof", "", "Serve net/http/pprof on this address during the run, e.g. :6060")
+	flag.StringVar(&cfg.CPUProfile, "cpuprofile", "", "Write a CPU profile of the run to this file")
+	flag.StringVar(&cfg.MemProfile, "memprofile", "", "Write a heap profile to this file once parsing is done")
+	flag.BoolVar(&cfg.Strict, "strict", false, "Fail when an XML file or entry is truncated, instead of keeping the plates read before the cut")
+	flag.StringVar(&cfg.Host, "host", ftpAddr, "Comma-separated list of FTP servers (host[:port]), tried in order until one connects")
+	flag.BoolVar(&cfg.HashPlates, "hash-plates", false, "Replace each plate with a salted SHA-256 hash (HMAC) of it, for sharing data without real plates")
+	flag.StringVar(&cfg.HashSalt, "hash-salt", "", "Secret salt for -hash-plates (better set in the -config file than on the command line)")
+	flag.StringVar(&cfg.Baseline, "baseline", "", "File recording the plate count of each run, to compare the run against previous ones")
+	flag.IntVar(&cfg.BaselineRuns, "baseline-runs", 7, "Number of previous runs the -baseline is averaged over")
+	flag.Float64Var(&cfg.BaselineTolerance, "baseline-tolerance", 20, "Allowed deviation from the -baseline, in percent")
+	flag.BoolVar(&cfg.BaselineFail, "baseline-fail", false, "Exit with code 4 instead of a warning when the run is outside the -baseline tolerance")
+
+	flag.BoolVar(&cfg.List, "list", false, "List the files on the FTP server, newest first, and exit without downloading")
+	flag.BoolVar(&cfg.Explain, "explain", false, "Print the effective options and what the run would do, without connecting or writing anything, then exit")
+	flag.StringVar(&cfg.Bytes, "bytes", "human", "How sizes are printed: human (scaled, e.g. 4.72 MB) or raw (plain byte counts)")
+	flag.Var(&cfg.MaxFileSize, "max-file-size", "Refuse to download files larger than this, e.g. 20GB (0 means unlimited)")
+	flag.StringVar(&cfg.Parquet, "parquet", "", "Export all plates to a Parquet file, with one typed column per field")
+	flag.StringVar(&cfg.Merge, "merge", "last", "How a record for a key that was already seen is stored: last (replace it), newest (keep the newer status) or fill (replace it, keeping fields it lacks)")
+	flag.StringVar(&cfg.OTLPEndpoint, "otlp-endpoint", "", "Export a trace of the run to this OTLP/HTTP collector, e.g. localhost:4318 or https://otel.example.org")
+	flag.StringVar(&cfg.InspectionDue, "inspection-due", "", "List vehicles last inspected before this date (YYYY-MM-DD), oldest inspection first")
+	flag.BoolVar(&cfg.Compact, "compact", false, "Only keep the fields listed in -fields in memory (plus any the key, sort or queries need), to save memory")
+	flag.StringVar(&cfg.DateLayouts, "date-layouts", strings.Join(dateLayouts, ","), "Comma-separated Go time layouts tried in order when parsing dates from the feed")
+	flag.StringVar(&cfg.TimeSeries, "timeseries", "", "Export the number of first registrations per -bucket as date,count rows to a CSV file (or JSON if it ends in .json)")
+	flag.StringVar(&cfg.Bucket, "bucket", "day", "Bucket of the -timeseries export: day, week (starting Monday) or month")
+	flag.Var(&cfg.InMemory, "in-memory", "Download archives up to this size, e.g. 500MB, into memory instead of a temp file (0 means always use a temp file)")
+	flag.IntVar(&cfg.Latest, "latest", 0, "List the N most recently registered vehicles, newest first")
+	flag.StringVar(&cfg.FTPMode, "ftp-mode", "epsv", "How FTP data connections are opened: epsv (extended passive, falling back to passive) or passive")
+	flag.StringVar(&cfg.FTPType, "ftp-type", "binary", "FTP transfer type: binary (TYPE I) or ascii (TYPE A, rewrites line endings and corrupts archives)")
+	flag.DurationVar(&cfg.TransferTimeout, "transfer-timeout", 0, "Give up on an FTP listing or download that takes longer than this, e.g. 2h (0 means no limit)")
+	flag.IntVar(&cfg.ExportFlush, "export-flush", 100000, "Flush the exports to disk every N rows. The -parquet export holds N rows in memory, as one row group, until they are written")
+	flag.StringVar(&cfg.PlateVINMap, "plate-vin-map", "", "Export a plate,vin lookup table to a CSV file, skipping records without either")
+	flag.StringVar(&cfg.ReportInvalid, "report-invalid", "", "Check the format and plausibility of the Danish plates, and export those that fail as plate,vin,problem,reason rows to a CSV file")
+	flag.StringVar(&cfg.Histograms, "histograms", "", "Export the number of vehicles per make, fuel type and first registration year as dimension,value,count rows to a CSV file (or JSON if it ends in .json), without any plates")
+	flag.IntVar(&cfg.KAnonymity, "k-anonymity", 10, "Merge the -histograms buckets with fewer than this many vehicles into \"other\"")
+	flag.DurationVar(&cfg.ConnectTimeout, "connect-timeout", 10*time.Second, "Give up connecting and logging in to an FTP server after this long")
+	flag.DurationVar(&cfg.IdleTimeout, "idle-timeout", 5*time.Minute, "Abandon an FTP transfer that receives no data for this long, and retry a download (0 means wait forever)")
+	flag.BoolVar(&cfg.IncludeEmpty, "include-empty-plates", false, "Keep records without a plate (or other -key value) under a numbered placeholder key instead of skipping them")
+	flag.BoolVar(&cfg.Reconcile, "reconcile", false, "Keep the plates of the previous -snapshot that are no longer in the feed, marked as inactive since this run")
+	flag.StringVar(&cfg.User, "user", "anonymous", "FTP user name, or vault:path#field to read it from HashiCorp Vault")
+	flag.StringVar(&cfg.Pass, "pass", "anonymous", "FTP password, or vault:path#field to read it from HashiCorp Vault (better set in the -config file than on the command line)")
+	flag.IntVar(&cfg.Repeated, "repeated", 0, "Report the N plates that occur most often in the feed, counting every record before duplicates are merged")
+	flag.StringVar(&cfg.Pattern, "pattern", "", "Only consider FTP files matching this wildcard pattern, e.g. 'ESStatistikListeModtag-2026*' (listed with NLST where the server supports it)")
+	flag.StringVar(&cfg.NewerThan, "newer-than", "", "Only consider FTP files modified on or after this date (YYYY-MM-DD)")
+	flag.StringVar(&cfg.ExportedSince, "exported-since", "", "Only write the records whose status changed or that were first registered on or after this date (YYYY-MM-DD) to -csv, -parquet, -plate-vin-map, -plates-txt and -report-invalid")
+	flag.IntVar(&cfg.Newest, "newest", 1, "Process the N newest archives on the FTP server into one dataset, oldest first, so records of newer files win with -merge last")
+	flag.Var(&cfg.ExpectMake, "expect-make", "Fail the run unless a make has the expected number of vehicles, e.g. Toyota:>10000 (repeatable, operators >, >=, <, <= and =)")
+	flag.StringVar(&cfg.Sink, "sink", "", "Publish each parsed record as JSON to a topic, given as kafka://host:port[,host:port]/topic or nats://host:port/subject")
+	flag.BoolVar(&cfg.SinkNewOnly, "sink-new-only", false, "Only publish records to the -sink whose key was not seen before in this run or the previous -snapshot")
+	flag.StringVar(&cfg.Replay, "replay", "", "Run the records of a stored -snapshot file through the -sink and exports again, instead of importing")
+	flag.IntVar(&cfg.PrefixStats, "prefix-stats", 0, "Report the number of plates per series, the leading letters of the plate up to this length (e.g. 2), most common first")
+	flag.Var(&cfg.CopyBufferSize, "copy-buffer-size", "Write downloads to the temp file in chunks of this size, e.g. 4MB (0 writes whatever each network read returns)")
+	flag.StringVar(&cfg.Changes, "changes", "", "Write the -fields that changed since the previous -snapshot to this file, one JSON change event per plate")
+	flag.Float64Var(&cfg.Sample, "sample", 1, "Only process this fraction of the records, chosen at random, e.g. 0.05 for about 5% (1 processes all)")
+	flag.Uint64Var(&cfg.Seed, "seed", 0, "Seed of the random -sample, to process the same records again (0 picks a seed and logs it)")
+	flag.BoolVar(&cfg.StatsOnly, "stats-only", false, "Only print a JSON report of the feed (counts, duplicates, rejects, makes, fuel types, years) to stdout, without storing or exporting the plates")
+	flag.BoolVar(&cfg.ProfileFields, "profile-fields", false, "Report the percentage of parsed records with each field set, to see what a feed populates")
+	flag.BoolVar(&cfg.MMap, "mmap", false, "Read zip archives, downloaded or local, through a memory mapping instead of a read syscall per block")
+	flag.StringVar(&cfg.SampleDisplay, "sample-display", "head", "Which 10 plates the summary shows: head (the first), tail (the last) or random, in -sort order. Exports always contain all plates")
+	flag.BoolVar(&cfg.KeepTmp, "keep-tmp", false, "Keep each FTP download with a record of its hash under -output-dir (or the temp directory), and parse it again instead of downloading while the remote file and the hash are unchanged")
+	flag.StringVar(&cfg.RunLog, "run-log", "", "Append a JSON line with the time, source, counts, duration and outcome of each run to this file, e.g. runs.jsonl")
+	flag.Var(&cfg.RunLogMaxSize, "run-log-max-size", "Rotate the -run-log to a .1 file when it would grow beyond this size, e.g. 10MB (0 never rotates it)")
+	flag.BoolVar(&cfg.CO2ByMake, "co2-by-make", false, "Report the average CO2 emissions and kerb weight per make, leaving out vehicles where they are unknown")
+	flag.IntVar(&cfg.ParallelDownloads, "parallel-downloads", 1, "With -newest, download up to this many of the archives at once, each over its own FTP connection, before processing them in order")
+	flag.StringVar(&cfg.Category, "category", "", "Only keep the vehicles of this EU vehicle category, e.g. M1, N1, L3e or unclassified")
+	flag.IntVar(&cfg.MaxEntries, "max-entries", 0, "Only process the first N XML entries of each zip or 7z archive, skipping the rest (0 processes all)")
+	flag.BoolVar(&cfg.REPL, "repl", false, "Once the plates are loaded, read query commands like get, prefix, make and count from stdin until quit (type help for the list)")
+	flag.StringVar(&cfg.PlatesTxt, "plates-txt", "", "Export the sorted, distinct plates to a text file, one per line and nothing else")
+	flag.Parse()
+
+	if cfg.ConfigFile != "" {
+		if err := loadConfigFile(cfg.ConfigFile, cfg); err != nil {
+			log.Fatalf("Error loading config: %v", err)
+		}
+		// Parse the command line again so flags override the values from the file.
+		// Repeatable flags append, so they are cleared first.
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name == "expect-make" {
+				cfg.ExpectMake = nil
+			}
+		})
+		flag.Parse()
+	}
+
+	switch cfg.Bytes {
+	case "human":
+	case "raw":
+		rawBytes = true
+	default:
+		log.Fatalf("Invalid -bytes %q: must be human or raw", cfg.Bytes)
+	}
+
+	// Checked before -list, which uses them as well
+	if cfg.Pattern != "" {
+		if _, err := path.Match(cfg.Pattern, ""); err != nil {
+			log.Fatalf("Invalid -pattern %q: %v", cfg.Pattern, err)
+		}
+	}
+	if cfg.NewerThan != "" {
+		date, err := time.Parse("2006-01-02", cfg.NewerThan)
+		if err != nil {
+			log.Fatalf("Invalid -newer-than %q: expected a date like 2026-01-31", cfg.NewerThan)
+		}
+		cfg.newerThan = date
+	}
+	if cfg.ExportedSince != "" {
+		date, err := time.Parse("2006-01-02", cfg.ExportedSince)
+		if err != nil {
+			log.Fatalf("Invalid -exported-since %q: expected a date like 2026-01-31", cfg.ExportedSince)
+		}
+		if cfg.PlatesOnly {
+			log.Fatalf("-plates-only does not extract dates, so it cannot be combined with -exported-since")
+		}
+		cfg.exportedSince = date
+	}
+
+	// Resolved up front, so a missing secret fails the run before anything else.
+	// Explaining a run does not contact Vault either.
+	if !cfg.Explain {
+		for _, secret := range []*string{&cfg.User, &cfg.Pass} {
+			value, err := resolveSecret(*secret)
+			if err != nil {
+				log.Fatalf("Error reading FTP credentials: %v", err)
+			}
+			*secret = value
+		}
+	}
+
+	// Listing is read-only, so it runs before anything is created on disk
+	if cfg.List {
+		if err := listFiles(cfg); err != nil {
+			log.Fatalf("Error listing FTP directory: %v", err)
+		}
+		return
+	}
+
+	var runDir string
+	if cfg.OutputDir != "" && cfg.Explain {
+		// Only the paths are resolved, the directory is not created
+		runDir = cfg.runDir(time.Now())
+		cfg.placeOutputs(runDir)
+	} else if cfg.OutputDir != "" {
+		var err error
+		runDir, err = cfg.useOutputDir(time.Now())
+		if err != nil {
+			log.Fatalf("Error preparing output directory: %v", err)
+		}
+		log.Printf("Writing output to %s\n", runDir)
+	}
+
+	if _, ok := keyFields[cfg.Key]; !ok {
+		log.Fatalf("Invalid -key %q: must be plate, vin or regid", cfg.Key)
+	}
+
+	if cfg.MappingFile != "" {
+		mapping, err := loadMapping(cfg.MappingFile)
+		if err != nil {
+			log.Fatalf("Error loading mapping: %v", err)
+		}
+		cfg.Mapping = mapping
+	}
+
+	if cfg.PlatesOnly && cfg.Key != "plate" {
+		log.Fatalf("-plates-only only extracts plates, so it cannot be combined with -key %s", cfg.Key)
+	}
+
+	if cfg.Replay != "" && (cfg.File != "" || cfg.ManifestIn != "" || cfg.Snapshot != "") {
+		log.Fatalf("-replay reads its records from the given snapshot, so it cannot be combined with -file, -manifest-in or -snapshot")
+	}
+
+	if cfg.Newest < 1 {
+		log.Fatalf("Invalid -newest %d: must be at least 1", cfg.Newest)
+	}
+	if cfg.Newest > 1 && (cfg.File != "" || cfg.ManifestIn != "" || cfg.Replay != "") {
+		log.Fatalf("-newest selects files on the FTP server, so it cannot be combined with -file, -manifest-in or -replay")
+	}
+	if cfg.ParallelDownloads < 1 {
+		log.Fatalf("Invalid -parallel-downloads %d: must be at least 1", cfg.ParallelDownloads)
+	}
+	if cfg.ParallelDownloads > 1 {
+		if cfg.Newest < 2 {
+			log.Fatalf("-parallel-downloads downloads the -newest archives at once, so it needs -newest 2 or more")
+		}
+		if cfg.KeepTmp {
+			log.Fatalf("-parallel-downloads does not keep its downloads, so it cannot be combined with -keep-tmp")
+		}
+	}
+
+	if cfg.StatsOnly {
+		for _, conflict := range []struct {
+			flag string
+			set  bool
+		}{
+			{"-snapshot", cfg.Snapshot != ""}, {"-replay", cfg.Replay != ""}, {"-csv", cfg.CSV != ""},
+			{"-parquet", cfg.Parquet != ""}, {"-timeseries", cfg.TimeSeries != ""}, {"-plate-vin-map", cfg.PlateVINMap != ""},
+			{"-plates-txt", cfg.PlatesTxt != ""},
+			{"-histograms", cfg.Histograms != ""}, {"-report-invalid", cfg.ReportInvalid != ""},
+			{"-sink", cfg.Sink != ""}, {"-baseline", cfg.Baseline != ""}, {"-expect-make", len(cfg.ExpectMake) > 0},
+			{"-repl", cfg.REPL},
+		} {
+			if conflict.set {
+				log.Fatalf("-stats-only does not store the plates, so it cannot be combined with %s", conflict.flag)
+			}
+		}
+		cfg.stats = newFeedStats()
+	}
+
+	if cfg.ProfileFields {
+		if cfg.Replay != "" {
+			log.Fatalf("-profile-fields counts the fields while parsing, so it cannot be combined with -replay")
+		}
+		cfg.profile = newFieldProfile()
+	}
+
+	if cfg.Reconcile && cfg.Snapshot == "" {
+		log.Fatalf("-reconcile compares the feed to the previous -snapshot, so it needs one")
+	}
+
+	if cfg.Changes != "" && cfg.Snapshot == "" {
+		log.Fatalf("-changes compares the feed to the previous -snapshot, so it needs one")
+	}
+
+	if cfg.PlatesOnly && len(cfg.ExpectMake) > 0 {
+		log.Fatalf("-plates-only does not extract makes, so it cannot be combined with -expect-make")
+	}
+	if cfg.PlatesOnly && cfg.CO2ByMake {
+		log.Fatalf("-plates-only does not extract makes or emissions, so it cannot be combined with -co2-by-make")
+	}
+	if cfg.Category != "" {
+		if cfg.PlatesOnly {
+			log.Fatalf("-plates-only does not extract vehicle types, so it cannot be combined with -category")
+		}
+		category, err := canonicalCategory(cfg.Category)
+		if err != nil {
+			log.Fatalf("Invalid -category: %v", err)
+		}
+		cfg.Category = category
+	}
+
+	if cfg.Sink != "" {
+		if _, _, _, err := parseSinkURL(cfg.Sink); err != nil {
+			log.Fatalf("Invalid -sink: %v", err)
+		}
+	} else if cfg.SinkNewOnly {
+		log.Fatalf("-sink-new-only needs a -sink to publish to")
+	}
+
+	if cfg.PlatesOnly && cfg.PlateVINMap != "" {
+		log.Fatalf("-plates-only does not extract VINs, so it cannot be combined with -plate-vin-map")
+	}
+
+	if cfg.Histograms != "" {
+		if cfg.PlatesOnly {
+			log.Fatalf("-plates-only only extracts plates, so it cannot be combined with -histograms")
+		}
+		if cfg.KAnonymity < 1 {
+			log.Fatalf("Invalid -k-anonymity %d: must be at least 1", cfg.KAnonymity)
+		}
+	}
+
+	switch cfg.Merge {
+	case "last":
+	case "newest", "fill":
+		if cfg.PlatesOnly {
+			log.Fatalf("-plates-only only extracts plates, so there is nothing to -merge %s", cfg.Merge)
+		}
+	default:
+		log.Fatalf("Invalid -merge %q: must be last, newest or fill", cfg.Merge)
+	}
+
+	if cfg.HashPlates {
+		if cfg.HashSalt == "" {
+			log.Fatalf("-hash-plates needs a -hash-salt, plates hashed without a secret are easy to recover")
+		}
+		if cfg.Range != "" || cfg.Fuzzy != "" || cfg.Regex != "" || cfg.PrefixStats > 0 || cfg.ReportInvalid != "" {
+			log.Fatalf("-range, -fuzzy, -regex, -prefix-stats and -report-invalid use the plate text, so they cannot be combined with -hash-plates")
+		}
+	}
+
+	if cfg.ConnectTimeout <= 0 {
+		log.Fatalf("Invalid -connect-timeout %v: must be positive", cfg.ConnectTimeout)
+	}
+
+	switch cfg.FTPMode {
+	case "epsv", "passive":
+	case "active":
+		log.Fatalf("-ftp-mode active is not supported by the FTP client, use passive or epsv")
+	default:
+		log.Fatalf("Invalid -ftp-mode %q: must be epsv or passive", cfg.FTPMode)
+	}
+
+	switch cfg.FTPType {
+	case "binary":
+	case "ascii":
+		log.Printf("Warning: -ftp-type ascii lets the server rewrite line endings, which corrupts zip and 7z archives")
+	default:
+		log.Fatalf("Invalid -ftp-type %q: must be binary or ascii", cfg.FTPType)
+	}
+
+	if utf8.RuneCountInString(cfg.CSVDelim) != 1 {
+		log.Fatalf("Invalid -csv-delim %q: must be a single character", cfg.CSVDelim)
+	}
+	cfg.csvComma, _ = utf8.DecodeRuneInString(cfg.CSVDelim)
+	if cfg.csvComma == '"' || cfg.csvComma == '\r' || cfg.csvComma == '\n' || cfg.csvComma == utf8.RuneError {
+		log.Fatalf("Invalid -csv-delim %q: cannot be a quote, a line break or an invalid character", cfg.CSVDelim)
+	}
+
+	if cfg.SampleDisplay != "head" && cfg.SampleDisplay != "tail" && cfg.SampleDisplay != "random" {
+		log.Fatalf("Invalid -sample-display %q: must be head, tail or random", cfg.SampleDisplay)
+	}
+
+	if cfg.Bucket != "day" && cfg.Bucket != "week" && cfg.Bucket != "month" {
+		log.Fatalf("Invalid -bucket %q: must be day, week or month", cfg.Bucket)
+	}
+
+	if cfg.BaselineRuns < 1 || cfg.BaselineTolerance < 0 {
+		log.Fatalf("-baseline-runs must be at least 1 and -baseline-tolerance must not be negative")
+	}
+
+	if cfg.Sort != "plate" && cfg.Sort != "natural" && cfg.Sort != "timestamp" {
+		log.Fatalf("Invalid -sort %q: must be plate, natural or timestamp", cfg.Sort)
+	}
+
+	dateLayouts = nil
+	for _, layout := range strings.Split(cfg.DateLayouts, ",") {
+		if layout = strings.TrimSpace(layout); layout != "" {
+			dateLayouts = append(dateLayouts, layout)
+		}
+	}
+	if len(dateLayouts) == 0 {
+		log.Fatalf("-date-layouts must list at least one layout")
+	}
+
+	fields, err := parseFields(cfg.FieldList)
+	if err != nil {
+		log.Fatalf("Invalid -fields: %v", err)
+	}
+	cfg.Fields = fields
+	if cfg.Compact {
+		cfg.compactFields = compactFieldSet(cfg)
+	}
+
+	if cfg.Range != "" {
+		parts := strings.SplitN(cfg.Range, ",", 2)
+		if len(parts) != 2 {
+			log.Fatalf("Invalid -range %q: expected lo,hi", cfg.Range)
+		}
+		cfg.rangeLo, cfg.rangeHi = strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		if cfg.rangeLo > cfg.rangeHi {
+			log.Fatalf("Invalid -range %q: lower bound %q is greater than upper bound %q", cfg.Range, cfg.rangeLo, cfg.rangeHi)
+		}
+	}
+
+	if cfg.Fuzzy != "" {
+		parts := strings.SplitN(cfg.Fuzzy, ",", 2)
+		if len(parts) != 2 {
+			log.Fatalf("Invalid -fuzzy %q: expected plate,dist", cfg.Fuzzy)
+		}
+		dist, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil || dist < 0 {
+			log.Fatalf("Invalid -fuzzy %q: distance must be a non-negative integer", cfg.Fuzzy)
+		}
+		cfg.fuzzyPlate, cfg.fuzzyDist = strings.TrimSpace(parts[0]), dist
+	}
+
+	if cfg.ExportFlush < 1 {
+		log.Fatalf("Invalid -export-flush %d: must be at least 1", cfg.ExportFlush)
+	}
+
+	if cfg.Latest < 0 {
+		log.Fatalf("Invalid -latest %d: must not be negative", cfg.Latest)
+	}
+	if cfg.MaxEntries < 0 {
+		log.Fatalf("Invalid -max-entries %d: must not be negative", cfg.MaxEntries)
+	}
+
+	if cfg.REPL && cfg.File == "-" {
+		log.Fatalf("-repl reads its commands from stdin, so it cannot be combined with -file -")
+	}
+
+	if cfg.PrefixStats < 0 {
+		log.Fatalf("Invalid -prefix-stats %d: must not be negative", cfg.PrefixStats)
+	}
+
+	if cfg.Sample <= 0 || cfg.Sample > 1 {
+		log.Fatalf("Invalid -sample %g: must be above 0 and at most 1", cfg.Sample)
+	}
+	if cfg.Sample < 1 {
+		if cfg.Seed == 0 {
+			cfg.Seed = rand.Uint64()
+		}
+		cfg.sampler = rand.New(rand.NewPCG(cfg.Seed, 0))
+	}
+
+	if cfg.Repeated < 0 {
+		log.Fatalf("Invalid -repeated %d: must not be negative", cfg.Repeated)
+	}
+	if cfg.Repeated > 0 {
+		cfg.plateCounts = make(map[string]int)
+	}
+
+	if cfg.InspectionDue != "" {
+		date, err := time.Parse("2006-01-02", cfg.InspectionDue)
+		if err != nil {
+			log.Fatalf("Invalid -inspection-due %q: expected a date like 2026-01-31", cfg.InspectionDue)
+		}
+		cfg.inspectionDue = date
+	}
+
+	// The pattern is compiled again by queryRegex, this only catches typos before
+	// the import rather than after it
+	if cfg.Regex != "" {
+		if _, err := regexp.Compile(cfg.Regex); err != nil {
+			log.Fatalf("Invalid -regex %q: %v", cfg.Regex, err)
+		}
+	}
+
+	// Explained after all options are validated, so the plan is one that can run
+	if cfg.Explain {
+		explainRun(cfg, runDir)
+		return
+	}
+
+	// Use simple map instead of memdb
+	plates := make(map[string]Vehicle, 100000) // Pre-allocate with estimated capacity
+
+	// Every run ends up in the -run-log. It is written once run has returned, so
+	// after the profile and trace are flushed, and only then does a failed run exit.
+	start := time.Now()
+	code, reason := 0, ""
+	if err := run(cfg, plates, start); err != nil {
+		code, reason = 1, err.Error()
+		var exitErr *exitError
+		if errors.As(err, &exitErr) {
+			code = exitErr.code
+		} else {
+			reason = "Error " + reason
+			log.Print(reason)
+		}
+	}
+	writeRunLog(cfg, start, len(plates), code, reason)
+	if code != 0 {
+		os.Exit(code)
+	}
+}
+
+// run imports the plates into plates and produces everything cfg asks for. The
+// errors read as what failed, e.g. "exporting CSV: ...". A run that ends with
+// another exit code than 1 returns an *exitError, which has been logged already.
+func run(cfg *Config, plates map[string]Vehicle, start time.Time) (err error) {
+	// With -stats-only stdout only gets the report, the usual output goes to stderr
+	statsOut := os.Stdout
+	if cfg.stats != nil {
+		os.Stdout = os.Stderr
+	}
+
+	if cfg.PprofAddr != "" {
+		go func() {
+			log.Printf("Serving pprof on http://%s/debug/pprof/\n", cfg.PprofAddr)
+			if err := http.ListenAndServe(cfg.PprofAddr, nil); err != nil {
+				log.Printf("Warning: pprof server stopped: %v", err)
+			}
+		}()
+	}
+
+	if cfg.CPUProfile != "" {
+		stop, err := startCPUProfile(cfg.CPUProfile)
+		if err != nil {
+			return fmt.Errorf("starting CPU profile: %w", err)
+		}
+		defer stop()
+	}
+
+	if cfg.OTLPEndpoint != "" {
+		stop, err := startTracing(cfg.OTLPEndpoint)
+		if err != nil {
+			return fmt.Errorf("setting up tracing: %w", err)
+		}
+		defer stop()
+	}
+
+	// Stage spans are children of the run span. Without -otlp-endpoint the global
+	// tracer provider is a no-op, so they cost next to nothing.
+	var runSpan trace.Span
+	cfg.ctx, runSpan = tracer.Start(context.Background(), "run")
+	defer func() {
+		endSpan(runSpan, err)
+	}()
+
+	var sink *recordSink
+	if cfg.Sink != "" {
+		var err error
+		if sink, err = openSink(cfg); err != nil {
+			return fmt.Errorf("connecting to -sink: %w", err)
+		}
+		// Records are published while parsing, so only the queue is left to send,
+		// also when the run fails part way
+		defer func() {
+			if err := sink.Close(); err != nil {
+				log.Printf("Warning: failed to close -sink: %v", err)
+			}
+		}()
+		cfg.onInsert = func(key string, vehicle Vehicle, isNew bool) {
+			if !cfg.SinkNewOnly || (isNew && !cfg.sinkKnown[key]) {
+				sink.add(key, vehicle)
+			}
+		}
+	}
+
+	if cfg.Replay != "" {
+		log.Printf("Replaying snapshot: %s\n", cfg.Replay)
+		if err := replaySnapshot(cfg, cfg.Replay, plates); err != nil {
+			return fmt.Errorf("replaying snapshot: %w", err)
+		}
+	} else if cfg.ManifestIn != "" {
+		log.Printf("Using manifest: %s\n", cfg.ManifestIn)
+		err := withSnapshot(cfg, cfg.ManifestIn, time.Time{}, plates, func() error {
+			return processManifest(cfg.ManifestIn, plates, cfg)
+		})
+		if err != nil {
+			return fmt.Errorf("processing manifest: %w", err)
+		}
+	} else if cfg.File == "-" {
+		// There is no modification time for stdin, so a snapshot is always rebuilt
+		log.Println("Reading from stdin...")
+		err := withSnapshot(cfg, "stdin", time.Time{}, plates, func() error {
+			return processLocalFile(cfg.File, plates, cfg)
+		})
+		if err != nil {
+			return fmt.Errorf("processing stdin: %w", err)
+		}
+	} else if cfg.File != "" {
+		log.Printf("Using local file: %s\n", cfg.File)
+		var modTime time.Time
+		if info, err := os.Stat(cfg.File); err == nil {
+			modTime = info.ModTime()
+		}
+		err := withSnapshot(cfg, cfg.File, modTime, plates, func() error {
+			return processLocalFile(cfg.File, plates, cfg)
+		})
+		if err != nil {
+			return fmt.Errorf("processing local file: %w", err)
+		}
+	} else {
+		log.Println("No file specified, downloading from FTP server...")
+		if err := downloadAndProcess(plates, cfg); err != nil {
+			if errors.Is(err, errNoZipFiles) {
+				log.Printf("Warning: nothing to download: %v", err)
+				return &exitError{exitNoZipFiles, fmt.Sprintf("nothing to download: %v", err)}
+			}
+			return fmt.Errorf("downloading and processing: %w", err)
+		}
+	}
+
+	if len(cfg.unknownTypes) > 0 {
+		var vehicles int
+		for _, count := range cfg.unknownTypes {
+			vehicles += count
+		}
+		log.Printf("Warning: %d vehicles of %d unknown types are %s", vehicles, len(cfg.unknownTypes), unclassified)
+	}
+	if cfg.badDates > maxDateWarnings {
+		log.Printf("Warning: %d dates could not be parsed and were left empty", cfg.badDates)
+	}
+
+	if cfg.Compact {
+		// Collected first, so the heap size is what the plates actually hold on to
+		runtime.GC()
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+		fmt.Printf("✓ -compact kept %s and dropped %s of other field data (heap in use: %s)\n",
+			strings.Join(slices.Sorted(maps.Keys(cfg.compactFields)), ","), humanizeBytes(cfg.compactDropped), humanizeBytes(int64(m.HeapAlloc)))
+	}
+
+	if cfg.emptyKeys > 0 {
+		fmt.Printf("✓ Kept %d records without a %s (-include-empty-plates)\n", cfg.emptyKeys, cfg.Key)
+	}
+	if cfg.sampler != nil {
+		fmt.Printf("✓ Sampled %d of %d records (%.1f%%, -sample %g -seed %d)\n",
+			cfg.sampled, cfg.scanned, float64(cfg.sampled)/float64(max(cfg.scanned, 1))*100, cfg.Sample, cfg.Seed)
+	}
+	if cfg.otherCategories > 0 {
+		fmt.Printf("✓ Skipped %d records of other categories than %s (-category)\n", cfg.otherCategories, cfg.Category)
+	}
+	if cfg.merged > 0 {
+		fmt.Printf("✓ Merged %d records into an existing plate (-merge %s)\n", cfg.merged, cfg.Merge)
+	}
+	if cfg.profile != nil {
+		cfg.profile.report()
+	}
+
+	if cfg.MemProfile != "" {
+		if err := writeHeapProfile(cfg.MemProfile); err != nil {
+			log.Printf("Warning: failed to write heap profile: %v", err)
+		}
+	}
+
+	if cfg.stats != nil {
+		cfg.stats.Duration = time.Since(start).Seconds()
+		if err := cfg.stats.write(statsOut); err != nil {
+			return fmt.Errorf("writing stats: %w", err)
+		}
+		return nil
+	}
+
+	// Checked before anything is displayed or exported, so a partial feed does not
+	// end up in the exports when the run fails
+	if cfg.Baseline != "" {
+		if err := checkBaseline(cfg, len(plates)); err != nil {
+			if !errors.Is(err, errOutsideBaseline) {
+				return fmt.Errorf("checking baseline: %w", err)
+			}
+			if cfg.BaselineFail {
+				log.Printf("Error: %v", err)
+				return &exitError{exitOutsideBaseline, err.Error()}
+			}
+			log.Printf("Warning: %v", err)
+		}
+	}
+
+	if len(cfg.ExpectMake) > 0 {
+		if failed := checkMakeExpectations(cfg.ExpectMake, plates); failed > 0 {
+			log.Printf("Error: %d of %d make expectations failed", failed, len(cfg.ExpectMake))
+			return &exitError{exitExpectationFailed, fmt.Sprintf("%d of %d make expectations failed", failed, len(cfg.ExpectMake))}
+		}
+	}
+
+	displaySummary(plates, cfg.Sort, cfg.SampleDisplay)
+
+	if cfg.CSV != "" {
+		if err := exportCSV(cfg.CSV, plates, cfg); err != nil {
+			return fmt.Errorf("exporting CSV: %w", err)
+		}
+	}
+
+	if cfg.Parquet != "" {
+		if err := exportParquet(cfg.Parquet, plates, cfg.Sort, cfg.exportedSince, cfg.ExportFlush); err != nil {
+			return fmt.Errorf("exporting Parquet: %w", err)
+		}
+	}
+
+	if cfg.TimeSeries != "" {
+		if err := exportTimeSeries(cfg.TimeSeries, plates, cfg.Bucket); err != nil {
+			return fmt.Errorf("exporting time series: %w", err)
+		}
+	}
+
+	if cfg.PlateVINMap != "" {
+		if err := exportPlateVINMap(cfg.PlateVINMap, plates, cfg.Sort, cfg.exportedSince, cfg.ExportFlush); err != nil {
+			return fmt.Errorf("exporting plate to VIN map: %w", err)
+		}
+	}
+
+	if cfg.PlatesTxt != "" {
+		if err := exportPlatesTxt(cfg.PlatesTxt, plates, cfg.Key, cfg.Sort, cfg.exportedSince, cfg.ExportFlush); err != nil {
+			return fmt.Errorf("exporting plates: %w", err)
+		}
+	}
+
+	if cfg.ReportInvalid != "" {
+		if err := exportInvalidPlates(cfg.ReportInvalid, plates, cfg.Sort, cfg.exportedSince, cfg.ExportFlush); err != nil {
+			return fmt.Errorf("exporting invalid plates: %w", err)
+		}
+	}
+
+	if cfg.Histograms != "" {
+		if err := exportHistograms(cfg.Histograms, plates, cfg.KAnonymity); err != nil {
+			return fmt.Errorf("exporting histograms: %w", err)
+		}
+	}
+
+	if cfg.Range != "" {
+		results, err := queryRange(plates, cfg.rangeLo, cfg.rangeHi)
+		if err != nil {
+			return fmt.Errorf("querying range: %w", err)
+		}
+		displayQueryResults(listedBy(cfg, "Plates between %s and %s", cfg.rangeLo, cfg.rangeHi), results)
+	}
+
+	if cfg.Fuzzy != "" {
+		results := queryFuzzy(plates, cfg.fuzzyPlate, cfg.fuzzyDist)
+		displayQueryResults(listedBy(cfg, "Plates within distance %d of %s", cfg.fuzzyDist, cfg.fuzzyPlate), results)
+	}
+
+	if cfg.Regex != "" {
+		results, err := queryRegex(plates, cfg.Regex)
+		if err != nil {
+			return fmt.Errorf("querying regex: %w", err)
+		}
+		displayQueryResults(listedBy(cfg, "Plates matching %s", cfg.Regex), results)
+	}
+
+	if cfg.InspectionDue != "" {
+		results := queryInspectionDue(plates, cfg.inspectionDue)
+		displayQueryResults(listedBy(cfg, "Vehicles last inspected before %s", cfg.InspectionDue), results)
+	}
+
+	if cfg.Repeated > 0 {
+		reportRepeatedPlates(cfg.plateCounts, cfg.Repeated)
+	}
+
+	if cfg.PrefixStats > 0 {
+		reportPrefixStats(plates, cfg.PrefixStats)
+	}
+
+	if cfg.CO2ByMake {
+		reportCO2ByMake(plates)
+	}
+
+	if cfg.Latest > 0 {
+		results := queryLatest(plates, cfg.Latest)
+		displayQueryResults(listedBy(cfg, "%d most recently registered vehicles", cfg.Latest), results)
+	}
+
+	if cfg.REPL {
+		if err := runREPL(os.Stdin, plates, cfg); err != nil {
+			return fmt.Errorf("reading commands: %w", err)
+		}
+	}
+	return nil
+}
+
+func processLocalFile(filePath string, plates map[string]Vehicle, cfg *Config) error {
+	if filePath == "-" {
+		return processStdin(plates, cfg)
+	}
+
+	ext := strings.ToLower(filepath.Ext(filePath))
+
+	switch ext {
+	case ".xml":
+		file, err := os.Open(filePath)
+		if err != nil {
+			return fmt.Errorf("failed to open XML file: %w", err)
+		}
+		defer file.Close()
+
+		parseProgress := &ProgressReader{
+			reader: file,
+			format: parseProgressFormat,
+		}
+		if info, err := file.Stat(); err == nil {
+			parseProgress.total = info.Size()
+		}
+
+		return processXML(filePath, parseProgress, parseProgress, plates, cfg)
+
+	case ".zip":
+		parts, err := localSplitParts(filePath)
+		if err != nil {
+			return err
+		}
+		if len(parts) > 0 {
+			return processSplitZipFiles(append(parts, filePath), plates, cfg)
+		}
+		return processZipFile(filePath, plates, cfg)
+
+	case ".7z":
+		return process7zFile(filePath, plates, cfg)
+
+	default:
+		return fmt.Errorf("unsupported file type: %s (must be .xml, .zip or .7z)", ext)
+	}
+}
+
+// processXML parses a single XML document from reader, with parseProgress being the
+// reader it is read through. The records parsed before a failure are already in the
+// map, so they are kept.
+func processXML(name string, reader io.Reader, parseProgress *ProgressReader, plates map[string]Vehicle, cfg *Config) error {
+	start := time.Now()
+	count, err := streamXML(name, reader, plates, cfg)
+	if errors.Is(err, errMemoryLimit) || errors.Is(err, errFeedMismatch) {
+		return err
+	}
+	if errors.Is(err, errTruncatedXML) && cfg.Strict {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	if err != nil {
+		logPartialEntry(name, count, parseProgress.current, parseProgress.total, err)
+		reportIncompleteEntries([]entryResult{{name, count, err}})
+	}
+
+	elapsed := time.Since(start)
+	fmt.Printf("\n✓ Successfully processed %d license plates in %v (%s)\n", count, elapsed.Round(time.Millisecond), recordRate(count, elapsed))
+	return nil
+}
+
+// processStdin processes a zip or 7z archive or an XML file, optionally gzipped, read
+// from stdin. The format is detected from the first bytes. XML is parsed as it arrives,
+// while an archive needs random access, so it is buffered to a temp file first.
+func processStdin(plates map[string]Vehicle, cfg *Config) error {
+	input := bufio.NewReader(os.Stdin)
+	magic, err := input.Peek(6)
+	if len(magic) == 0 {
+		return fmt.Errorf("failed to read stdin: %w", err)
+	}
+
+	// The length is only known when stdin is redirected from a file
+	progress := &ProgressReader{
+		reader: input,
+		format: parseProgressFormat,
+	}
+	if info, err := os.Stdin.Stat(); err == nil && info.Mode().IsRegular() {
+		progress.total = info.Size()
+	}
+
+	is7z := bytes.HasPrefix(magic, []byte("7z\xbc\xaf\x27\x1c"))
+
+	switch {
+	case bytes.HasPrefix(magic, []byte("PK\x03\x04")) || is7z:
+		tempFile, err := os.CreateTemp("", "stdin-archive-*")
+		if err != nil {
+			return fmt.Errorf("failed to create temp file: %w", err)
+		}
+		defer os.Remove(tempFile.Name())
+		defer tempFile.Close()
+
+		progress.format = bufferProgressFormat
+		written, err := io.Copy(tempFile, progress)
+		if err != nil {
+			return fmt.Errorf("failed to buffer stdin: %w", err)
+		}
+		fmt.Printf("\n✓ Buffered %s\n", humanizeBytes(written))
+		tempFile.Close()
+
+		if is7z {
+			return process7zFile(tempFile.Name(), plates, cfg)
+		}
+		return processZipFile(tempFile.Name(), plates, cfg)
+
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		gz, err := gzip.NewReader(progress)
+		if err != nil {
+			return fmt.Errorf("failed to read gzip from stdin: %w", err)
+		}
+		defer gz.Close()
+
+		return processXML("stdin", gz, progress, plates, cfg)
+
+	default:
+		return processXML("stdin", progress, progress, plates, cfg)
+	}
+}
+
+func processZipFile(zipPath string, plates map[string]Vehicle, cfg *Config) error {
+	if cfg.MMap {
+		return processMappedZipFile(zipPath, plates, cfg)
+	}
+
+	r, err := zip.OpenReader(zipPath)
+	if err != nil {
+		return fmt.Errorf("failed to open zip file: %w", err)
+	}
+	defer r.Close()
+
+	return processZipReader(&r.Reader, plates, cfg)
+}
+
+// processMappedZipFile reads a zip archive through a read-only memory mapping, so
+// the decompressor reads from the page cache without a syscall per block
+func processMappedZipFile(zipPath string, plates map[string]Vehicle, cfg *Config) error {
+	m, err := mmap.Open(zipPath)
+	if err != nil {
+		return fmt.Errorf("failed to map zip file: %w", err)
+	}
+	defer m.Close()
+
+	r, err := zip.NewReader(m, int64(m.Len()))
+	if err != nil {
+		return fmt.Errorf("failed to open zip file: %w", err)
+	}
+	return processZipReader(r, plates, cfg)
+}
+
+// splitPartNames returns the .z01, .z02, ... parts of the split zip archive zipName
+// among names, in order. It is empty if the archive is not split. A gap in the part
+// numbers is reported as an error, missing parts after the last one found are only
+// noticed by joinSplitZip.
+func splitPartNames(zipName string, names []string) ([]string, error) {
+	if !strings.EqualFold(filepath.Ext(zipName), ".zip") {
+		return nil, nil
+	}
+	prefix := strings.TrimSuffix(zipName, filepath.Ext(zipName)) + ".z"
+
+	parts := make(map[int]string)
+	last := 0
+	for _, name := range names {
+		if len(name) <= len(prefix) || !strings.EqualFold(name[:len(prefix)], prefix) {
+			continue
+		}
+		digits := name[len(prefix):]
+		if strings.Trim(digits, "0123456789") != "" {
+			continue
+		}
+		n, err := strconv.Atoi(digits)
+		if err != nil || n == 0 {
+			continue
+		}
+		parts[n] = name
+		last = max(last, n)
+	}
+
+	ordered := make([]string, 0, last)
+	var missing []string
+	for n := 1; n <= last; n++ {
+		if name, ok := parts[n]; ok {
+			ordered = append(ordered, name)
+		} else {
+			missing = append(missing, fmt.Sprintf("%s%02d", prefix, n))
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("split archive %s is missing %s", zipName, strings.Join(missing, ", "))
+	}
+	return ordered, nil
+}
+
+// localSplitParts returns the paths of the .z01, .z02, ... parts next to a local zip
+// archive, see splitPartNames
+func localSplitParts(zipPath string) ([]string, error) {
+	dirEntries, err := os.ReadDir(filepath.Dir(zipPath))
+	if err != nil {
+		return nil, fmt.Errorf("failed to look for split archive parts: %w", err)
+	}
+	names := make([]string, len(dirEntries))
+	for i, e := range dirEntries {
+		names[i] = e.Name()
+	}
+	parts, err := splitPartNames(filepath.Base(zipPath), names)
+	if err != nil {
+		return nil, err
+	}
+	for i, part := range parts {
+		parts[i] = filepath.Join(filepath.Dir(zipPath), part)
+	}
+	return parts, nil
+}
+
+// processSplitZipFiles joins the parts of a split zip archive, the .zip last, into a
+// temp file and processes it
+func processSplitZipFiles(paths []string, plates map[string]Vehicle, cfg *Config) error {
+	name := paths[len(paths)-1]
+	fmt.Printf("Joining %s, split into %d parts\n", name, len(paths))
+
+	tempFile, err := os.CreateTemp("", "split-archive-*.zip")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %w", err)
+	}
+	defer os.Remove(tempFile.Name())
+	defer tempFile.Close()
+
+	starts := make([]int64, len(paths))
+	var offset int64
+	for i, path := range paths {
+		starts[i] = offset
+		part, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("failed to open split archive part: %w", err)
+		}
+		written, err := io.Copy(tempFile, part)
+		part.Close()
+		if err != nil {
+			return fmt.Errorf("failed to copy %s: %w", path, err)
+		}
+		offset += written
+	}
+
+	if err := joinSplitZip(tempFile, starts); err != nil {
+		return fmt.Errorf("failed to join split archive %s: %w", name, err)
+	}
+	tempFile.Close()
+	return processZipFile(tempFile.Name(), plates, cfg)
+}
+
+// Records of the zip format rewritten by joinSplitZip, see the APPNOTE of PKWARE
+const (
+	zipDirHeaderSig  = 0x02014b50
+	zipDirHeaderLen  = 46
+	zipDirEndSig     = 0x06054b50
+	zipDirEndLen     = 22
+	zip64DirEndSig   = 0x06064b50
+	zip64DirEndLen   = 56
+	zip64LocatorSig  = 0x07064b50
+	zip64LocatorLen  = 20
+	zip64ExtraID     = 0x0001
+	zipMaxComment    = 0xffff
+	zip64VersionNeed = 45
+)
+
+// joinSplitZip turns the parts of a split zip archive, concatenated in file with part
+// i starting at starts[i], into a single archive that archive/zip can read. A split
+// archive is a single archive cut into pieces, so the file data needs no change. But
+// its central directory gives each offset relative to the start of the part it is in,
+// so it is rewritten with offsets from the start of the file, using zip64 fields where
+// they no longer fit.
+func joinSplitZip(file *os.File, starts []int64) error {
+	le := binary.LittleEndian
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+
+	// The end record closes the last part, followed by a comment of up to 64KB
+	tail := make([]byte, min(size, zipDirEndLen+zipMaxComment))
+	if _, err := file.ReadAt(tail, size-int64(len(tail))); err != nil {
+		return err
+	}
+	i := bytes.LastIndex(tail, le.AppendUint32(nil, zipDirEndSig))
+	if i < 0 || len(tail)-i < zipDirEndLen {
+		return errors.New("end of central directory not found")
+	}
+	end := tail[i:]
+	endOffset := size - int64(len(tail)) + int64(i)
+	comment := end[zipDirEndLen:min(len(end), zipDirEndLen+int(le.Uint16(end[20:])))]
+
+	disk := uint64(le.Uint16(end[4:]))
+	dirDisk := uint64(le.Uint16(end[6:]))
+	entries := uint64(le.Uint16(end[10:]))
+	dirSize := uint64(le.Uint32(end[12:]))
+	dirOffset := uint64(le.Uint32(end[16:]))
+
+	// Values that do not fit the end record are in the zip64 end record, which the
+	// locator right before the end record points to
+	if endOffset >= zip64LocatorLen {
+		locator := make([]byte, zip64LocatorLen)
+		if _, err := file.ReadAt(locator, endOffset-zip64LocatorLen); err != nil {
+			return err
+		}
+		if le.Uint32(locator) == zip64LocatorSig {
+			recordDisk := uint64(le.Uint32(locator[4:]))
+			if recordDisk >= uint64(len(starts)) {
+				return fmt.Errorf("zip64 end record is in part %d of %d", recordDisk+1, len(starts))
+			}
+			record := make([]byte, zip64DirEndLen)
+			if _, err := file.ReadAt(record, starts[recordDisk]+int64(le.Uint64(locator[8:]))); err != nil {
+				return err
+			}
+			if le.Uint32(record) != zip64DirEndSig {
+				return errors.New("zip64 end of central directory not found")
+			}
+			disk = uint64(le.Uint32(record[16:]))
+			dirDisk = uint64(le.Uint32(record[20:]))
+			entries = le.Uint64(record[32:])
+			dirSize = le.Uint64(record[40:])
+			dirOffset = le.Uint64(record[48:])
+		}
+	}
+
+	// The end record is in the last part, which knows how many parts there are
+	if disk != uint64(len(starts)-1) {
+		return fmt.Errorf("the archive has %d parts, but only %d were found", disk+1, len(starts))
+	}
+	if dirDisk >= uint64(len(starts)) {
+		return fmt.Errorf("central directory is in part %d of %d", dirDisk+1, len(starts))
+	}
+
+	dirStart := starts[dirDisk] + int64(dirOffset)
+	dir := make([]byte, dirSize)
+	if _, err := file.ReadAt(dir, dirStart); err != nil {
+		return fmt.Errorf("failed to read central directory: %w", err)
+	}
+
+	var out bytes.Buffer
+	for n := uint64(0); n < entries; n++ {
+		if len(dir) < zipDirHeaderLen || le.Uint32(dir) != zipDirHeaderSig {
+			return fmt.Errorf("central directory entry %d of %d is corrupt", n+1, entries)
+		}
+		nameLen, extraLen, commentLen := int(le.Uint16(dir[28:])), int(le.Uint16(dir[30:])), int(le.Uint16(dir[32:]))
+		if len(dir) < zipDirHeaderLen+nameLen+extraLen+commentLen {
+			return fmt.Errorf("central directory entry %d of %d is corrupt", n+1, entries)
+		}
+		header := bytes.Clone(dir[:zipDirHeaderLen])
+		name := dir[zipDirHeaderLen : zipDirHeaderLen+nameLen]
+		extra := dir[zipDirHeaderLen+nameLen : zipDirHeaderLen+nameLen+extraLen]
+		fileComment := dir[zipDirHeaderLen+nameLen+extraLen : zipDirHeaderLen+nameLen+extraLen+commentLen]
+		dir = dir[zipDirHeaderLen+nameLen+extraLen+commentLen:]
+
+		compressed := uint64(le.Uint32(header[20:]))
+		uncompressed := uint64(le.Uint32(header[24:]))
+		fileDisk := uint64(le.Uint16(header[34:]))
+		offset := uint64(le.Uint32(header[42:]))
+
+		// The zip64 extra field holds the values whose field is saturated, in this
+		// order. It is replaced, the other extra fields are kept as they are.
+		var kept []byte
+		for len(extra) >= 4 {
+			id, dataLen := le.Uint16(extra), int(le.Uint16(extra[2:]))
+			if len(extra) < 4+dataLen {
+				break
+			}
+			data := extra[4 : 4+dataLen]
+			if id != zip64ExtraID {
+				kept = append(kept, extra[:4+dataLen]...)
+			}
+			for _, v := range []*uint64{&uncompressed, &compressed, &offset} {
+				if id == zip64ExtraID && *v == math.MaxUint32 && len(data) >= 8 {
+					*v, data = le.Uint64(data), data[8:]
+				}
+			}
+			if id == zip64ExtraID && fileDisk == math.MaxUint16 && len(data) >= 4 {
+				fileDisk = uint64(le.Uint32(data))
+			}
+			extra = extra[4+dataLen:]
+		}
+		if fileDisk >= uint64(len(starts)) {
+			return fmt.Errorf("%s is in part %d of %d", name, fileDisk+1, len(starts))
+		}
+		offset += uint64(starts[fileDisk])
+
+		var zip64 []byte
+		for _, field := range []struct {
+			at    int
+			value uint64
+		}{{24, uncompressed}, {20, compressed}, {42, offset}} {
+			if field.value >= math.MaxUint32 {
+				zip64 = le.AppendUint64(zip64, field.value)
+				le.PutUint32(header[field.at:], math.MaxUint32)
+			} else {
+				le.PutUint32(header[field.at:], uint32(field.value))
+			}
+		}
+		if len(zip64) > 0 {
+			kept = le.AppendUint16(kept, zip64ExtraID)
+			kept = le.AppendUint16(kept, uint16(len(zip64)))
+			kept = append(kept, zip64...)
+		}
+		le.PutUint16(header[30:], uint16(len(kept)))
+		le.PutUint16(header[34:], 0)
+
+		out.Write(header)
+		out.Write(name)
+		out.Write(kept)
+		out.Write(fileComment)
+	}
+
+	newSize := uint64(out.Len())
+	if entries >= math.MaxUint16 || newSize >= math.MaxUint32 || uint64(dirStart) >= math.MaxUint32 {
+		record := le.AppendUint32(nil, zip64DirEndSig)
+		record = le.AppendUint64(record, zip64DirEndLen-12)
+		record = le.AppendUint16(record, zip64VersionNeed)
+		record = le.AppendUint16(record, zip64VersionNeed)
+		record = le.AppendUint32(record, 0) // this disk
+		record = le.AppendUint32(record, 0) // disk with the central directory
+		record = le.AppendUint64(record, entries)
+		record = le.AppendUint64(record, entries)
+		record = le.AppendUint64(record, newSize)
+		record = le.AppendUint64(record, uint64(dirStart))
+		out.Write(record)
+
+		locator := le.AppendUint32(nil, zip64LocatorSig)
+		locator = le.AppendUint32(locator, 0)
+		locator = le.AppendUint64(locator, uint64(dirStart)+newSize)
+		locator = le.AppendUint32(locator, 1)
+		out.Write(locator)
+	}
+	record := le.AppendUint32(nil, zipDirEndSig)
+	record = le.AppendUint16(record, 0)
+	record = le.AppendUint16(record, 0)
+	record = le.AppendUint16(record, uint16(min(entries, math.MaxUint16)))
+	record = le.AppendUint16(record, uint16(min(entries, math.MaxUint16)))
+	record = le.AppendUint32(record, uint32(min(newSize, math.MaxUint32)))
+	record = le.AppendUint32(record, uint32(min(uint64(dirStart), math.MaxUint32)))
+	record = le.AppendUint16(record, uint16(len(comment)))
+	record = append(record, comment...)
+	out.Write(record)
+
+	// The new directory replaces the old one and everything after it
+	if err := file.Truncate(dirStart); err != nil {
+		return err
+	}
+	if _, err := file.WriteAt(out.Bytes(), dirStart); err != nil {
+		return err
+	}
+	return nil
+}
+
+// processZipReader processes the XML entries of an opened zip archive
+func processZipReader(r *zip.Reader, plates map[string]Vehicle, cfg *Config) error {
+	files := make([]archiveFile, len(r.File))
+	for i, zipFile := range r.File {
+		files[i] = archiveFile{
+			name:  zipFile.Name,
+			size:  int64(zipFile.UncompressedSize64),
+			isDir: zipFile.FileInfo().IsDir(),
+			open:  zipFile.Open,
+		}
+	}
+	return processArchive(files, plates, cfg)
+}
+
+func process7zFile(path string, plates map[string]Vehicle, cfg *Config) error {
+	r, err := sevenzip.OpenReader(path)
+	if err != nil {
+		return fmt.Errorf("failed to open 7z file: %w", err)
+	}
+	defer r.Close()
+
+	return process7zReader(&r.Reader, plates, cfg)
+}
+
+// process7zReader processes the XML entries of an opened 7z archive
+func process7zReader(r *sevenzip.Reader, plates map[string]Vehicle, cfg *Config) error {
+	files := make([]archiveFile, len(r.File))
+	for i, sevenZipFile := range r.File {
+		files[i] = archiveFile{
+			name:  sevenZipFile.Name,
+			size:  int64(sevenZipFile.UncompressedSize),
+			isDir: sevenZipFile.FileInfo().IsDir(),
+			open:  sevenZipFile.Open,
+		}
+	}
+	return processArchive(files, plates, cfg)
+}
+
+// archiveFile is an entry of a zip or 7z archive
+type archiveFile struct {
+	name  string
+	size  int64 // uncompressed size, as listed in the archive
+	isDir bool
+	open  func() (io.ReadCloser, error)
+}
+
+// processArchive processes the XML entries of an archive in the order they are
+// listed. Entries that cannot be opened are skipped with a warning. With -max-entries
+// it stops after that many entries, however many records they had.
+func processArchive(files []archiveFile, plates map[string]Vehicle, cfg *Config) error {
+	// Malformed archives can contain several entries with the same name. Only the
+	// largest of them is processed, so the plates are not counted twice.
+	largest := make(map[string]int, len(files))
+	for i, file := range files {
+		if current, ok := largest[file.name]; !ok || file.size > files[current].size {
+			largest[file.name] = i
+		}
+	}
+
+	isXML := func(file archiveFile) bool {
+		return !file.isDir && strings.HasSuffix(strings.ToLower(file.name), ".xml")
+	}
+
+	// Parse progress is measured in uncompressed bytes across all entries that will
+	// be processed, as listed in the archive
+	parseProgress := &ProgressReader{
+		format: parseProgressFormat,
+	}
+	entries := 0
+	for i, file := range files {
+		if isXML(file) && largest[file.name] == i && (cfg.MaxEntries == 0 || entries < cfg.MaxEntries) {
+			parseProgress.total += file.size
+			entries++
+		}
+	}
+
+	processedCount := 0
+	processedEntries, skippedEntries := 0, 0
+	var results []entryResult
+	started := time.Now()
+
+	for i, file := range files {
+		if !isXML(file) {
+			continue
+		}
+
+		if largest[file.name] != i {
+			log.Printf("Warning: skipping duplicate entry %s (%s), only the largest entry with this name is processed",
+				file.name, humanizeBytes(file.size))
+			continue
+		}
+
+		if cfg.MaxEntries > 0 && processedEntries == cfg.MaxEntries {
+			skippedEntries++
+			continue
+		}
+		processedEntries++
+
+		fmt.Printf("Processing: %s (%s)\n", file.name, humanizeBytes(file.size))
+
+		rc, err := file.open()
+		if err != nil {
+			log.Printf("Warning: failed to open %s: %v", file.name, err)
+			results = append(results, entryResult{file.name, 0, err})
+			continue
+		}
+
+		parseProgress.reader = rc
+		start := parseProgress.current
+		count, err := streamEntry(file.name, parseProgress, plates, cfg)
+		rc.Close()
+
+		// Records are added to the map as they are parsed, so a failure part way
+		// through an entry keeps everything before it
+		processedCount += count
+		results = append(results, entryResult{file.name, count, err})
+
+		if errors.Is(err, errMemoryLimit) || errors.Is(err, errFeedMismatch) {
+			return err
+		}
+		if errors.Is(err, errTruncatedXML) && cfg.Strict {
+			return fmt.Errorf("%s: %w", file.name, err)
+		}
+		if err != nil {
+			logPartialEntry(file.name, count, parseProgress.current-start, file.size, err)
+		}
+	}
+
+	reportIncompleteEntries(results)
+	if skippedEntries > 0 {
+		fmt.Printf("\n✓ Stopped after %d entries (-max-entries), skipped the other %d\n", processedEntries, skippedEntries)
+	}
+	elapsed := time.Since(started)
+	fmt.Printf("\n✓ Successfully processed %d license plates in %v (%s)\n", processedCount, elapsed.Round(time.Millisecond), recordRate(processedCount, elapsed))
+	return nil
+}
+
+// errTruncatedXML is returned when the input ends before the XML document is
+// closed, which is what a cut off download or archive entry looks like
+var errTruncatedXML = errors.New("XML ends before the document is closed, the input is probably truncated")
+
+// entryResult records how parsing of one XML file or archive entry ended
+type entryResult struct {
+	name  string
+	count int
+	err   error // nil if the entry was parsed up to the close of its root element
+}
+
+// reportIncompleteEntries prints a summary of the entries that did not end cleanly,
+// so a truncated file is not lost among the progress output
+func reportIncompleteEntries(results []entryResult) {
+	var incomplete []entryResult
+	for _, result := range results {
+		if result.err != nil {
+			incomplete = append(incomplete, result)
+		}
+	}
+	if len(incomplete) == 0 {
+		return
+	}
+
+	fmt.Printf("\n⚠ %d of %d entries did not end cleanly:\n", len(incomplete), len(results))
+	for _, result := range incomplete {
+		status := "failed"
+		if errors.Is(result.err, errTruncatedXML) {
+			status = "TRUNCATED"
+		}
+		fmt.Printf("  %s: %s after %d license plates\n", result.name, status, result.count)
+	}
+}
+
+// hashPlate returns the hex encoded HMAC-SHA256 of plate keyed with salt. Without
+// the salt the plate cannot be recovered by hashing all possible plates.
+func hashPlate(salt, plate string) string {
+	mac := hmac.New(sha256.New, []byte(salt))
+	mac.Write([]byte(plate))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// compactFieldSet returns the fields kept in memory with -compact: those exported
+// with -fields, and those the key, the sort order, -merge and the queries depend on
+func compactFieldSet(cfg *Config) map[string]bool {
+	keep := map[string]bool{cfg.Key: true}
+	for _, f := range cfg.Fields {
+		keep[f.Name] = true
+	}
+	if cfg.Sort == "timestamp" {
+		keep["firstregistration"] = true
+	}
+	if cfg.Merge == "newest" {
+		keep["statustime"] = true
+		keep["firstregistration"] = true
+	}
+	if cfg.Range != "" || cfg.Fuzzy != "" || cfg.Regex != "" || cfg.PrefixStats > 0 {
+		keep["plate"] = true
+	}
+	if cfg.PlateVINMap != "" {
+		keep["plate"] = true
+		keep["vin"] = true
+	}
+	if cfg.PlatesTxt != "" {
+		keep["plate"] = true
+	}
+	if cfg.ReportInvalid != "" {
+		keep["plate"] = true
+		keep["vin"] = true
+	}
+	if cfg.ExportedSince != "" {
+		keep["statustime"] = true
+		keep["firstregistration"] = true
+	}
+	if cfg.Histograms != "" {
+		keep["make"] = true
+		keep["fueltype"] = true
+		keep["firstregistration"] = true
+		keep["category"] = true
+	}
+	if cfg.InspectionDue != "" {
+		keep["lastinspection"] = true
+	}
+	if cfg.Latest > 0 {
+		keep["firstregistration"] = true
+	}
+	if len(cfg.ExpectMake) > 0 {
+		keep["make"] = true
+	}
+	if cfg.CO2ByMake {
+		keep["make"] = true
+		keep["co2"] = true
+		keep["kerbweight"] = true
+	}
+	return keep
+}
+
+// compactVehicle clears the fields of v that are not in keep, and returns the number
+// of bytes of text that were dropped. The vehicle keeps its size, but the dropped
+// strings are no longer referenced and can be freed.
+func compactVehicle(v *Vehicle, keep map[string]bool) int64 {
+	var dropped int64
+	entry := plateEntry{vehicle: *v}
+	for _, f := range vehicleFields {
+		if !keep[f.Name] {
+			if value := f.Value(entry); value != "" {
+				dropped += int64(len(value))
+				f.Set(v, "", nil)
+			}
+		}
+	}
+	return dropped
+}
+
+// mergeVehicles combines the stored record for a key with a later record for the
+// same key, following the -merge policy:
+//
+//   - newest keeps the record with the most recent status change, falling back to
+//     the first registration date. Ties go to the later record.
+//   - fill keeps the later record, with its empty fields taken from the stored one.
+func mergeVehicles(policy string, existing, later Vehicle) Vehicle {
+	switch policy {
+	case "newest":
+		if recordTime(existing).After(recordTime(later)) {
+			return existing
+		}
+		return later
+	case "fill":
+		fill := func(field *string, value string) {
+			if *field == "" {
+				*field = value
+			}
+		}
+		fill(&later.Plate, existing.Plate)
+		fill(&later.VIN, existing.VIN)
+		fill(&later.RegID, existing.RegID)
+		fill(&later.Make, existing.Make)
+		fill(&later.Model, existing.Model)
+		fill(&later.FuelType, existing.FuelType)
+		fill(&later.Type, existing.Type)
+		fill(&later.Category, existing.Category)
+		if later.KerbWeight == 0 {
+			later.KerbWeight = existing.KerbWeight
+		}
+		if later.CO2 == 0 {
+			later.CO2 = existing.CO2
+		}
+		if later.FirstRegistration.IsZero() {
+			later.FirstRegistration = existing.FirstRegistration
+		}
+		if later.StatusTime.IsZero() {
+			later.StatusTime = existing.StatusTime
+		}
+		if later.LastInspection.IsZero() {
+			later.LastInspection = existing.LastInspection
+		}
+	}
+	return later
+}
+
+// recordTime is the time a record is dated by for -merge newest and -exported-since
+func recordTime(v Vehicle) time.Time {
+	if !v.StatusTime.IsZero() {
+		return v.StatusTime
+	}
+	return v.FirstRegistration
+}
+
+// logPartialEntry reports an entry that failed part way through, and how far
+// into it parsing got before the failure
+func logPartialEntry(name string, count int, read, total int64, err error) {
+	log.Printf("Warning: failed to process %s after %d license plates (%s of %s read): %v",
+		name, count, humanizeBytes(read), humanizeBytes(total), err)
+}
+
+// streamEntry runs streamXML on one zip entry, turning a panic while parsing it into
+// an error, so a broken entry cannot take the remaining entries down with it
+func streamEntry(name string, reader io.Reader, plates map[string]Vehicle, cfg *Config) (count int, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Error: panic while processing %s: %v\n%s", name, r, debug.Stack())
+			err = fmt.Errorf("panic while processing: %v", r)
+		}
+	}()
+	return streamXML(name, reader, plates, cfg)
+}
+
+// skipElement consumes the tokens of an element whose start tag was just read, up to
+// and including its end tag
+func skipElement(nextToken func() (xml.Token, error)) error {
+	for depth := 1; depth > 0; {
+		token, err := nextToken()
+		if err != nil {
+			return err
+		}
+		switch token.(type) {
+		case xml.StartElement:
+			depth++
+		case xml.EndElement:
+			depth--
+		}
+	}
+	return nil
+}
+
+// maxDecodeWarnings caps the records per file or entry that a decode warning is
+// logged for, so a malformed feed does not flood the log
+const maxDecodeWarnings = 10
+
+// A file or entry in which more than maxDecodeFailureRate of the records failed to
+// decode is given up on, once at least decodeFailureMinRecords were decoded. A single
+// bad record is skipped, but that many means the feed no longer matches Statistik,
+// and skipping them would silently lose most of the data.
+const (
+	maxDecodeFailureRate    = 0.1
+	decodeFailureMinRecords = 1000
+)
+
+// maxRecordBytes caps the bytes of a record kept by recordingReader, which holds
+// far more fields than recordFields lists
+const maxRecordBytes = 4096
+
+// recordingReader keeps the first maxRecordBytes bytes the XML decoder reads while
+// recording is set, so a record that fails to decode can be shown. The decoder reads
+// an io.ByteReader one byte at a time without buffering ahead, so the bytes end where
+// decoding stopped.
+type recordingReader struct {
+	r         *bufio.Reader
+	buf       []byte
+	recording bool
+}
+
+func (r *recordingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if r.recording {
+		r.buf = append(r.buf, p[:min(n, maxRecordBytes-len(r.buf))]...)
+	}
+	return n, err
+}
+
+func (r *recordingReader) ReadByte() (byte, error) {
+	b, err := r.r.ReadByte()
+	if err == nil && r.recording && len(r.buf) < maxRecordBytes {
+		r.buf = append(r.buf, b)
+	}
+	return b, err
+}
+
+// maxFailureFields caps the fields of a failed record listed by recordFields
+const maxFailureFields = 20
+
+// recordFields lists the elements with text in the start of a record that failed to
+// decode, as name=value, up to where decoding stopped
+func recordFields(data []byte) string {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	var fields []string
+	var name string
+	for len(fields) < maxFailureFields {
+		token, err := decoder.RawToken()
+		if err != nil {
+			break
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			name = t.Name.Local
+		case xml.CharData:
+			if text := strings.TrimSpace(string(t)); text != "" && name != "" {
+				fields = append(fields, fmt.Sprintf("%s=%q", name, text))
+			}
+		case xml.EndElement:
+			name = ""
+		}
+	}
+	if len(fields) == 0 {
+		return "none"
+	}
+	return strings.Join(fields, ", ")
+}
+
+// streamXML parses the Statistik records read from reader into plates. name is the
+// file or zip entry being read, used to locate problems in the log.
+func streamXML(name string, reader io.Reader, plates map[string]Vehicle, cfg *Config) (processedCount int, err error) {
+	onRecord := newRecordProgress()
+
+	// Without a full decode there is no need for the namespace translation and
+	// nesting checks done by Token, so the cheaper RawToken is used throughout
+	rawTokens := cfg.PlatesOnly || cfg.Mapping != nil
+
+	// Only a full decode can fail on a record, so only then is it recorded
+	var recorder *recordingReader
+	if !rawTokens {
+		recorder = &recordingReader{r: bufio.NewReader(reader)}
+		reader = recorder
+	}
+	decoder := xml.NewDecoder(reader)
+
+	span := cfg.startSpan("parse", attribute.String("file.name", name))
+	defer func() {
+		span.SetAttributes(attribute.Int("records", processedCount), attribute.Int64("bytes", decoder.InputOffset()))
+		endSpan(span, err)
+	}()
+	records := 0
+	skipped := 0
+	decodeFailures := 0
+	var firstFailure string
+	defer func() {
+		if decodeFailures > maxDecodeWarnings {
+			log.Printf("Warning: %d of %d Statistik records in %s failed to decode", decodeFailures, records, name)
+		}
+		if cfg.stats != nil {
+			cfg.stats.Records += decodeFailures
+			cfg.stats.Undecodable += decodeFailures
+			cfg.stats.Bytes += decoder.InputOffset()
+		}
+	}()
+
+	// parseError wraps a decoder error, telling a cut off input apart from
+	// malformed XML. Token reports an unclosed document as a syntax error, while
+	// RawToken and the record scanners just return io.EOF
+	parseError := func(err error) error {
+		var syntaxErr *xml.SyntaxError
+		if err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF) || (errors.As(err, &syntaxErr) && syntaxErr.Msg == "unexpected EOF") {
+			return fmt.Errorf("XML parse error: %w (at byte %d)", errTruncatedXML, decoder.InputOffset())
+		}
+		return fmt.Errorf("XML parse error: %w", err)
+	}
+
+	nextToken := decoder.Token
+	if rawTokens {
+		nextToken = decoder.RawToken
+	}
+
+	// The document is complete once its root element has been closed again. Token
+	// reports an unclosed document as a syntax error itself, RawToken does not, so
+	// depth counts the open elements outside of records. It is not reliable with
+	// Token, as a record that fails to decode leaves its remaining tokens behind.
+	depth := 0
+	started := false
+	rootClosed := false
+
+	for {
+		token, err := nextToken()
+		if err == io.EOF && (rootClosed || (started && !rawTokens)) {
+			break
+		}
+		if err != nil {
+			return processedCount, parseError(err)
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			// Records are consumed up to and including their end element below
+			if t.Name.Local != "Statistik" {
+				depth++
+			}
+			started = true
+		case xml.EndElement:
+			depth--
+			rootClosed = depth == 0
+		}
+
+		if se, ok := token.(xml.StartElement); ok && se.Name.Local == "Statistik" {
+			var vehicle Vehicle
+			records++
+			offset := decoder.InputOffset()
+
+			// Skipped before decoding, which is most of the cost of a record
+			if cfg.sampler != nil {
+				cfg.scanned++
+				if cfg.sampler.Float64() >= cfg.Sample {
+					skipped++
+					if err := skipElement(nextToken); err != nil {
+						return processedCount, parseError(err)
+					}
+					continue
+				}
+				cfg.sampled++
+			}
+
+			if cfg.PlatesOnly {
+				plate, err := scanPlate(nextToken)
+				if err != nil {
+					return processedCount, parseError(err)
+				}
+				vehicle.Plate = plate
+			} else if cfg.Mapping != nil {
+				values, err := scanMapped(nextToken, cfg.Mapping)
+				if err != nil {
+					return processedCount, parseError(err)
+				}
+				vehicle = vehicleFromValues(values, cfg)
+			} else {
+				var stat Statistik
+
+				// Only the first failure is shown, so later records are not recorded
+				recorder.buf, recorder.recording = recorder.buf[:0], firstFailure == ""
+				err := decoder.DecodeElement(&stat, &se)
+				recorder.recording = false
+				if err != nil {
+					if err := parseError(err); errors.Is(err, errTruncatedXML) {
+						return processedCount, err
+					}
+					decodeFailures++
+					if decodeFailures <= maxDecodeWarnings {
+						log.Printf("Warning: failed to decode Statistik record %d in %s (at byte %d): %v", records, name, offset, err)
+					}
+					if decodeFailures == maxDecodeWarnings {
+						log.Printf("Warning: not logging further decode failures in %s", name)
+					}
+					if firstFailure == "" {
+						firstFailure = fmt.Sprintf("record %d (at byte %d): %v, with the fields %s", records, offset, err, recordFields(recorder.buf))
+					}
+					if decoded := records - skipped; decoded >= decodeFailureMinRecords && float64(decodeFailures) > maxDecodeFailureRate*float64(decoded) {
+						return processedCount, fmt.Errorf("%w: %d of the first %d Statistik records in %s, so the feed most likely no longer matches "+
+							"the Statistik struct, e.g. a field with another type or nesting. The first to fail was %s (up to where it failed)", errFeedMismatch, decodeFailures, decoded, name, firstFailure)
+					}
+					continue
+				}
+
+				vehicle = newVehicle(&stat, cfg)
+			}
+
+			if vehicle.Category == "" && vehicle.Type != "" {
+				countUnknownType(&vehicle, cfg)
+			}
+
+			// Hashing before the key is taken keys the map on the hash as well
+			if cfg.HashPlates && vehicle.Plate != "" {
+				vehicle.Plate = hashPlate(cfg.HashSalt, vehicle.Plate)
+			}
+
+			// Counted before anything is skipped or merged, empty plates included
+			if cfg.plateCounts != nil {
+				cfg.plateCounts[vehicle.Plate]++
+			}
+			if cfg.profile != nil {
+				cfg.profile.add(&vehicle)
+			}
+
+			if cfg.Category != "" && vehicle.Category != cfg.Category {
+				cfg.otherCategories++
+				continue
+			}
+
+			if cfg.Compact {
+				cfg.compactDropped += compactVehicle(&vehicle, cfg.compactFields)
+			}
+
+			key := cfg.keyOf(&vehicle)
+			if key == "" && cfg.IncludeEmpty {
+				// Each record gets a key of its own, as they cannot be told apart
+				cfg.emptyKeys++
+				key = fmt.Sprintf(emptyKeyFormat, cfg.emptyKeys)
+			}
+
+			// Only counted, so the memory use stays flat apart from the keys
+			if cfg.stats != nil {
+				cfg.stats.add(key, &vehicle)
+				if key != "" {
+					processedCount++
+					onRecord(processedCount)
+				}
+				continue
+			}
+
+			if key != "" {
+				existing, seen := plates[key]
+				if seen && cfg.Merge != "last" {
+					vehicle = mergeVehicles(cfg.Merge, existing, vehicle)
+					cfg.merged++
+				}
+				plates[key] = vehicle
+				processedCount++
+				onRecord(processedCount)
+				if cfg.onInsert != nil {
+					cfg.onInsert(key, vehicle, !seen)
+				}
+
+				if processedCount%memoryCheckInterval == 0 {
+					if err := checkMemory(cfg.MaxMemory, processedCount); err != nil {
+						return processedCount, err
+					}
+				}
+			}
+		}
+	}
+
+	return processedCount, nil
+}
+
+const (
+	ftpAddr = "5.44.137.84:21"
+	ftpDir  = "/ESStatistikListeModtag"
+
+	// maxReconnects caps how many times a session reconnects before giving up
+	maxReconnects = 3
+
+	// Each host is tried connectAttempts times, waiting connectBackoff before the
+	// second attempt and twice as long before every further one
+	connectAttempts = 3
+	connectBackoff  = 2 * time.Second
+)
+
+// vaultTimeout bounds reading a secret from Vault
+const vaultTimeout = 10 * time.Second
+
+// resolveSecret returns value, or the secret it refers to if it has the form
+// vault:path#field
+func resolveSecret(value string) (string, error) {
+	ref, ok := strings.CutPrefix(value, "vault:")
+	if !ok {
+		return value, nil
+	}
+	return readVaultSecret(ref)
+}
+
+// readVaultSecret reads a field of a secret from HashiCorp Vault. ref is path#field,
+// where path is the API path below /v1/, e.g. secret/data/autoplate for a KV version
+// 2 engine mounted at secret. Like the vault CLI, the server and token are taken from
+// VAULT_ADDR and VAULT_TOKEN, and VAULT_NAMESPACE if it is set.
+func readVaultSecret(ref string) (string, error) {
+	path, field, ok := strings.Cut(ref, "#")
+	if !ok || path == "" || field == "" {
+		return "", fmt.Errorf("invalid secret vault:%s: expected vault:path#field", ref)
+	}
+
+	addr, token := os.Getenv("VAULT_ADDR"), os.Getenv("VAULT_TOKEN")
+	if addr == "" || token == "" {
+		return "", fmt.Errorf("VAULT_ADDR and VAULT_TOKEN must be set to read vault:%s", ref)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(addr, "/")+"/v1/"+strings.TrimPrefix(path, "/"), nil)
+	if err != nil {
+		return "", fmt.Errorf("invalid Vault address %q: %w", addr, err)
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if namespace := os.Getenv("VAULT_NAMESPACE"); namespace != "" {
+		req.Header.Set("X-Vault-Namespace", namespace)
+	}
+
+	client := &http.Client{Timeout: vaultTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to read vault:%s: %w", ref, err)
+	}
+	defer resp.Body.Close()
+
+	var secret struct {
+		Data   map[string]any `json:"data"`
+		Errors []string       `json:"errors"`
+	}
+	decodeErr := json.NewDecoder(resp.Body).Decode(&secret)
+	if resp.StatusCode != http.StatusOK {
+		if len(secret.Errors) > 0 {
+			return "", fmt.Errorf("failed to read vault:%s: %s: %s", ref, resp.Status, strings.Join(secret.Errors, "; "))
+		}
+		return "", fmt.Errorf("failed to read vault:%s: %s", ref, resp.Status)
+	}
+	if decodeErr != nil {
+		return "", fmt.Errorf("failed to read vault:%s: %w", ref, decodeErr)
+	}
+
+	// A KV version 2 engine nests the fields in data.data, next to data.metadata
+	data := secret.Data
+	if nested, ok := data["data"].(map[string]any); ok && data["metadata"] != nil {
+		data = nested
+	}
+
+	value, ok := data[field].(string)
+	if !ok {
+		return "", fmt.Errorf("secret %s has no string field %q", path, field)
+	}
+	return value, nil
+}
+
+// ftpSession is a logged in FTP connection in the registry directory that
+// transparently reconnects when the server drops the connection between commands
+type ftpSession struct {
+	cfg        *Config
+	hosts      []string
+	conn       *ftp.ServerConn
+	control    net.Conn       // network connection under conn, see dialFunc
+	board      *progressBoard // shows the progress of the downloads when several sessions download at once, nil otherwise
+	reconnects int
+}
+
+func newFTPSession(cfg *Config) (*ftpSession, error) {
+	session := &ftpSession{cfg: cfg, hosts: parseHosts(cfg.Host)}
+	if err := session.connect(); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// parseHosts splits a comma-separated host list, adding the default FTP port to
+// hosts given without one. An empty list means the registry's own server.
+func parseHosts(list string) []string {
+	var hosts []string
+	for _, host := range strings.Split(list, ",") {
+		host = strings.TrimSpace(host)
+		if host == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			host = net.JoinHostPort(host, "21")
+		}
+		hosts = append(hosts, host)
+	}
+	if len(hosts) == 0 {
+		hosts = []string{ftpAddr}
+	}
+	return hosts
+}
+
+// connect connects to the first host that accepts the connection, trying each
+// host connectAttempts times with a growing delay before moving on to the next
+func (s *ftpSession) connect() (err error) {
+	span := s.cfg.startSpan("connect", attribute.StringSlice("ftp.hosts", s.hosts))
+	defer func() { endSpan(span, err) }()
+
+	for i, host := range s.hosts {
+		delay := connectBackoff
+		for attempt := 1; attempt <= connectAttempts; attempt++ {
+			span.SetAttributes(attribute.String("ftp.host", host), attribute.Int("ftp.attempt", attempt))
+			if err = s.connectTo(host); err == nil {
+				if i > 0 {
+					log.Printf("Connected to FTP mirror %s", host)
+				} else {
+					log.Printf("Connected to FTP server %s", host)
+				}
+				return nil
+			}
+
+			if attempt < connectAttempts {
+				log.Printf("Warning: %s (%s attempt %d/%d), retrying in %v", err, host, attempt, connectAttempts, delay)
+				time.Sleep(delay)
+				delay *= 2
+			} else {
+				log.Printf("Warning: %s (%s attempt %d/%d), giving up on this host", err, host, attempt, connectAttempts)
+			}
+		}
+	}
+	if len(s.hosts) > 1 {
+		return fmt.Errorf("all %d FTP hosts failed, last error: %w", len(s.hosts), err)
+	}
+	return err
+}
+
+// connectTo dials host, logs in and changes to the registry directory
+func (s *ftpSession) connectTo(host string) error {
+	options := []ftp.DialOption{
+		ftp.DialWithDialFunc(s.dialFunc()),
+		// Behind NAT the server may not understand EPSV, or answer it with
+		// a port that cannot be reached, so passive mode skips it
+		ftp.DialWithDisabledEPSV(s.cfg.FTPMode == "passive"),
+	}
+	if s.cfg.TransferTimeout > 0 || s.cfg.IdleTimeout > 0 {
+		// When a transfer is abandoned, the server may never report it as
+		// closed, so reading that status must not wait forever either
+		options = append(options, ftp.DialWithShutTimeout(s.cfg.ConnectTimeout))
+	}
+	if s.cfg.FTPDebug {
+		options = append(options, ftp.DialWithDebugOutput(os.Stderr))
+	}
+
+	conn, err := ftp.Dial(host, options...)
+	if err != nil {
+		return fmt.Errorf("failed to connect to FTP: %w", err)
+	}
+
+	if err = conn.Login(s.cfg.User, s.cfg.Pass); err != nil {
+		conn.Quit()
+		return fmt.Errorf("failed to login: %w", err)
+	}
+
+	// The client asks for binary when it logs in, but a server that ignores
+	// it sends the archives as text, so the type is set again explicitly
+	transferType := ftp.TransferTypeBinary
+	if s.cfg.FTPType == "ascii" {
+		transferType = ftp.TransferTypeASCII
+	}
+	if err = conn.Type(transferType); err != nil {
+		conn.Quit()
+		return fmt.Errorf("failed to set the %s transfer type: %w", s.cfg.FTPType, err)
+	}
+
+	if err = conn.ChangeDir(ftpDir); err != nil {
+		conn.Quit()
+		return fmt.Errorf("failed to change directory: %w", err)
+	}
+
+	s.conn = conn
+	return nil
+}
+
+// dialFunc returns the dial function of a connection. The first connection it dials
+// is the control connection, which gets a deadline of ConnectTimeout for the greeting
+// and the login. Every later one is the data connection of a transfer, which gets a
+// deadline of TransferTimeout and fails when it is idle for IdleTimeout. A transfer
+// that hangs then fails with a timeout instead of blocking the run.
+func (s *ftpSession) dialFunc() func(network, address string) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: s.cfg.ConnectTimeout}
+	control := true
+	return func(network, address string) (net.Conn, error) {
+		conn, err := dialer.Dial(network, address)
+		if err != nil {
+			return nil, err
+		}
+
+		isControl := control
+		var deadline time.Time
+		switch {
+		case control:
+			control = false
+			s.control = conn
+			deadline = time.Now().Add(s.cfg.ConnectTimeout)
+		case s.cfg.TransferTimeout > 0:
+			deadline = time.Now().Add(s.cfg.TransferTimeout)
+		}
+		if !deadline.IsZero() {
+			if err := conn.SetDeadline(deadline); err != nil {
+				conn.Close()
+				return nil, err
+			}
+		}
+
+		if isControl || s.cfg.IdleTimeout <= 0 {
+			return conn, nil
+		}
+		return &idleConn{Conn: conn, idle: s.cfg.IdleTimeout, deadline: deadline}, nil
+	}
+}
+
+// idleConn is a data connection whose reads fail with a timeout when no data arrived
+// for idle, or at deadline if that is earlier
+type idleConn struct {
+	net.Conn
+	idle     time.Duration
+	deadline time.Time // zero when the transfer has no overall deadline
+}
+
+func (c *idleConn) Read(p []byte) (int, error) {
+	readDeadline := time.Now().Add(c.idle)
+	if !c.deadline.IsZero() && c.deadline.Before(readDeadline) {
+		readDeadline = c.deadline
+	}
+	if err := c.Conn.SetReadDeadline(readDeadline); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(p)
+}
+
+// do runs op on the connection. If op fails because the connection died, the session
+// reconnects, logs in, changes directory again and retries op, at most maxReconnects
+// times over the lifetime of the session.
+func (s *ftpSession) do(name string, op func(conn *ftp.ServerConn) error) error {
+	for {
+		// The status read after the previous transfer leaves a deadline on
+		// the control connection, see DialWithShutTimeout
+		if s.control != nil {
+			s.control.SetDeadline(time.Time{})
+		}
+
+		err := op(s.conn)
+		if err == nil || !isConnectionLost(err) || s.reconnects >= maxReconnects {
+			return err
+		}
+
+		s.reconnects++
+		log.Printf("Warning: FTP connection lost during %s (%v), reconnecting (%d/%d)", name, err, s.reconnects, maxReconnects)
+		if err := s.reconnect(); err != nil {
+			return err
+		}
+	}
+}
+
+// reconnect replaces the connection with a new one
+func (s *ftpSession) reconnect() error {
+	s.conn.Quit()
+	if err := s.connect(); err != nil {
+		return fmt.Errorf("failed to reconnect: %w", err)
+	}
+	return nil
+}
+
+func (s *ftpSession) Close() error {
+	return s.conn.Quit()
+}
+
+// printf prints a message about the session's downloads, through its progress
+// board if it has one
+func (s *ftpSession) printf(format string, args ...any) {
+	if s.board != nil {
+		s.board.printf(format, args...)
+		return
+	}
+	fmt.Printf(format, args...)
+}
+
+// isConnectionLost reports whether err means the control connection is gone,
+// as opposed to the server rejecting the command
+func isConnectionLost(err error) bool {
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) {
+		return protoErr.Code == ftp.StatusNotAvailable
+	}
+
+	var netErr net.Error
+	return errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.As(err, &netErr)
+}
+
+// listSelected returns the files of the registry directory that match -pattern and
+// were modified on or after -newer-than
+func (s *ftpSession) listSelected() ([]*ftp.Entry, error) {
+	var entries []*ftp.Entry
+	var err error
+	if s.cfg.Pattern != "" {
+		entries, err = s.listMatching(s.cfg.Pattern)
+	} else {
+		entries, err = s.list()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var files []*ftp.Entry
+	for _, entry := range entries {
+		if entry.Type != ftp.EntryTypeFile || entry.Time.Before(s.cfg.newerThan) {
+			continue
+		}
+		// Servers that do not support wildcards may list other files as well
+		if matched, _ := path.Match(s.cfg.Pattern, entry.Name); s.cfg.Pattern != "" && !matched {
+			continue
+		}
+		files = append(files, entry)
+	}
+	return files, nil
+}
+
+// listMatching returns the entries of the registry directory matching pattern.
+// The server is asked to filter the names with NLST, so only the matching files are
+// transferred, and their size and time are then asked for one by one. If the server
+// cannot report file times, or does not support NLST, the full listing is returned
+// for the caller to filter instead.
+func (s *ftpSession) listMatching(pattern string) ([]*ftp.Entry, error) {
+	if !s.conn.IsGetTimeSupported() {
+		return s.list()
+	}
+
+	var names []string
+	err := s.do("NameList", func(conn *ftp.ServerConn) (err error) {
+		names, err = conn.NameList(pattern)
+		return err
+	})
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) && protoErr.Code == ftp.StatusFileUnavailable {
+		// Some servers answer a pattern without matches with an error
+		return nil, nil
+	}
+	if err != nil {
+		log.Printf("Warning: listing %s with NLST failed (%v), listing the whole directory", pattern, err)
+		return s.list()
+	}
+
+	entries := make([]*ftp.Entry, 0, len(names))
+	for _, name := range names {
+		entry := &ftp.Entry{Name: path.Base(name), Type: ftp.EntryTypeFile}
+		err := s.do("Stat", func(conn *ftp.ServerConn) error {
+			size, err := conn.FileSize(entry.Name)
+			if err != nil {
+				return err
+			}
+			entry.Size = uint64(size)
+			entry.Time, err = conn.GetTime(entry.Name)
+			return err
+		})
+		var protoErr *textproto.Error
+		if errors.As(err, &protoErr) {
+			// SIZE fails on directories, which NLST lists as well
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat %s: %w", entry.Name, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// list returns the entries of the registry directory
+func (s *ftpSession) list() ([]*ftp.Entry, error) {
+	var entries []*ftp.Entry
+	err := s.do("List", func(conn *ftp.ServerConn) (err error) {
+		entries, err = conn.List(".")
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list directory: %w", err)
+	}
+	return entries, nil
+}
+
+// scanPlate reads the remaining tokens of a Statistik element up to its end tag and
+// returns the text of its RegistreringNummerNummer child, skipping the unmarshaling
+// of everything else in the element
+func scanPlate(nextToken func() (xml.Token, error)) (string, error) {
+	var plate []byte
+	depth := 0
+	inPlate := false
+
+	for {
+		token, err := nextToken()
+		if err != nil {
+			return "", err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			depth++
+			inPlate = depth == 1 && t.Name.Local == "RegistreringNummerNummer"
+		case xml.EndElement:
+			if depth == 0 {
+				return string(plate), nil
+			}
+			depth--
+			inPlate = false
+		case xml.CharData:
+			// The decoder unescapes entities and returns CDATA sections as CharData too,
+			// so a plate mixing text, entities and CDATA arrives in several pieces
+			if inPlate {
+				plate = append(plate, t...)
+			}
+		}
+	}
+}
+
+// listFiles prints the files in the registry directory with their size and
+// modification time, newest first
+func listFiles(cfg *Config) error {
+	session, err := newFTPSession(cfg)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	files, err := session.listSelected()
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		return files[i].Time.After(files[j].Time)
+	})
+
+	fmt.Printf("\n=== Files in %s (%d total) ===\n", ftpDir, len(files))
+	for _, file := range files {
+		fmt.Printf("%s  %12s  %s\n", file.Time.Format(time.RFC3339), humanizeBytes(int64(file.Size)), file.Name)
+	}
+	return nil
+}
+
+// errNoZipFiles is returned when the registry directory exists but has no zip (or
+// 7z) files, which usually means the next file has not been published yet
+var errNoZipFiles = errors.New("no zip or 7z files found in directory")
+
+// isArchive reports whether name is an archive that can be downloaded and processed
+func isArchive(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	return ext == ".zip" || ext == ".7z"
+}
+
+// runLogRecord is the line appended to the -run-log for each run
+type runLogRecord struct {
+	Start      time.Time  `json:"start"`
+	Duration   float64    `json:"duration_seconds"`
+	Source     string     `json:"source,omitempty"`
+	SourceTime *time.Time `json:"source_time,omitempty"`
+	Plates     int        `json:"plates"`
+	Merged     int        `json:"merged"`
+	Outcome    string     `json:"outcome"` // ok or failed
+	ExitCode   int        `json:"exit_code"`
+	Error      string     `json:"error,omitempty"`
+}
+
+// writeRunLog appends the record of a run to the -run-log, first rotating the log
+// to a .1 file if the record would take it beyond -run-log-max-size. A failure to
+// write it is only a warning, so it does not change the outcome of the run.
+func writeRunLog(cfg *Config, start time.Time, plates, exitCode int, failure string) {
+	if cfg.RunLog == "" {
+		return
+	}
+
+	record := runLogRecord{
+		Start:    start,
+		Duration: time.Since(start).Seconds(),
+		Source:   cfg.source,
+		Plates:   plates,
+		Merged:   cfg.merged,
+		Outcome:  "ok",
+		ExitCode: exitCode,
+		Error:    failure,
+	}
+	if cfg.Replay != "" {
+		record.Source = cfg.Replay
+	}
+	if !cfg.sourceTime.IsZero() {
+		record.SourceTime = &cfg.sourceTime
+	}
+	if exitCode != 0 {
+		record.Outcome = "failed"
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		log.Printf("Warning: failed to write -run-log: %v", err)
+		return
+	}
+	line = append(line, '\n')
+
+	if info, err := os.Stat(cfg.RunLog); err == nil && cfg.RunLogMaxSize > 0 && info.Size()+int64(len(line)) > int64(cfg.RunLogMaxSize) {
+		if err := os.Rename(cfg.RunLog, cfg.RunLog+".1"); err != nil {
+			log.Printf("Warning: failed to rotate -run-log: %v", err)
+		}
+	}
+
+	file, err := os.OpenFile(cfg.RunLog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		log.Printf("Warning: failed to write -run-log: %v", err)
+		return
+	}
+	defer file.Close()
+	if _, err := file.Write(line); err != nil {
+		log.Printf("Warning: failed to write -run-log: %v", err)
+	}
+}
+
+// exitError ends a run with another exit code than 1, see run
+type exitError struct {
+	code   int
+	reason string
+}
+
+func (e *exitError) Error() string {
+	return e.reason
+}
+
+// exitNoZipFiles is the exit code used when there was nothing to download, so
+// schedulers can tell a late feed apart from a failure (exit code 1)
+const exitNoZipFiles = 3
+
+// errOutsideBaseline is returned when the plate count of a run deviates from the
+// baseline by more than the tolerance, which usually means a partial feed
+var errOutsideBaseline = errors.New("plate count is outside the baseline")
+
+// exitOutsideBaseline is the exit code used with -baseline-fail when the run is
+// outside the baseline
+const exitOutsideBaseline = 4
+
+// runSummary is the line recorded in the -baseline file for each run
+type runSummary struct {
+	Time      time.Time `json:"time"`
+	Plates    int       `json:"plates"`
+	Anomalous bool      `json:"anomalous,omitempty"` // outside the baseline, so left out of later baselines
+}
+
+// checkBaseline compares the plate count of this run to the average of the last
+// BaselineRuns normal runs, and appends the run to the baseline file. The first run
+// only records the count. Runs outside the tolerance are recorded as anomalous, so
+// a partial feed does not drag the baseline down.
+func checkBaseline(cfg *Config, plates int) error {
+	history, err := readBaseline(cfg.Baseline)
+	if err != nil {
+		return err
+	}
+
+	var recent []runSummary
+	for _, run := range history {
+		if !run.Anomalous {
+			recent = append(recent, run)
+		}
+	}
+	if len(recent) > cfg.BaselineRuns {
+		recent = recent[len(recent)-cfg.BaselineRuns:]
+	}
+
+	summary := runSummary{Time: time.Now().UTC(), Plates: plates}
+	var deviation error
+	if len(recent) > 0 {
+		total := 0
+		for _, run := range recent {
+			total += run.Plates
+		}
+		baseline := float64(total) / float64(len(recent))
+		percent := (float64(plates) - baseline) / baseline * 100
+
+		log.Printf("Baseline: %d plates, %+.1f%% from the average of %.0f over the last %d runs", plates, percent, baseline, len(recent))
+		if percent > cfg.BaselineTolerance || -percent > cfg.BaselineTolerance {
+			summary.Anomalous = true
+			deviation = fmt.Errorf("%w: %d plates is %+.1f%% from the average of %.0f, more than the allowed %.0f%%",
+				errOutsideBaseline, plates, percent, baseline, cfg.BaselineTolerance)
+		}
+	} else {
+		log.Printf("Baseline: no previous runs in %s, recording %d plates", cfg.Baseline, plates)
+	}
+
+	if err := appendBaseline(cfg.Baseline, summary); err != nil {
+		return err
+	}
+	return deviation
+}
+
+// readBaseline reads the runs recorded in the baseline file, oldest first. A
+// missing file has no runs.
+func readBaseline(path string) ([]runSummary, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open baseline: %w", err)
+	}
+	defer file.Close()
+
+	var runs []runSummary
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var run runSummary
+		if err := json.Unmarshal(scanner.Bytes(), &run); err != nil {
+			return nil, fmt.Errorf("%s line %d: %w", path, line, err)
+		}
+		runs = append(runs, run)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read baseline: %w", err)
+	}
+	return runs, nil
+}
+
+// appendBaseline adds a run to the end of the baseline file
+func appendBaseline(path string, summary runSummary) error {
+	line, err := json.Marshal(summary)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open baseline: %w", err)
+	}
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write baseline: %w", err)
+	}
+	return file.Close()
+}
+
+// fieldProfile counts the parsed records with each field of Vehicle set, for
+// -profile-fields. The fields are found by reflection, so new ones are profiled
+// without changes here; those tagged profile:"-" are not set by parsing.
+type fieldProfile struct {
+	records int
+	fields  []reflect.StructField
+	set     []int
+}
+
+func newFieldProfile() *fieldProfile {
+	p := &fieldProfile{}
+	for _, field := range reflect.VisibleFields(reflect.TypeFor[Vehicle]()) {
+		if field.IsExported() && field.Tag.Get("profile") != "-" {
+			p.fields = append(p.fields, field)
+		}
+	}
+	p.set = make([]int, len(p.fields))
+	return p
+}
+
+// add counts the fields of v that are not the zero value
+func (p *fieldProfile) add(v *Vehicle) {
+	p.records++
+	value := reflect.ValueOf(v).Elem()
+	for i, field := range p.fields {
+		if !value.FieldByIndex(field.Index).IsZero() {
+			p.set[i]++
+		}
+	}
+}
+
+// report prints the percentage of records with each field set, in field order
+func (p *fieldProfile) report() {
+	fmt.Printf("\n=== Field profile (%d records) ===\n", p.records)
+	width := 0
+	for _, field := range p.fields {
+		width = max(width, len(field.Name))
+	}
+	for i, field := range p.fields {
+		fmt.Printf("  %-*s %6.1f%%  (%d)\n", width, field.Name, float64(p.set[i])/float64(max(p.records, 1))*100, p.set[i])
+	}
+}
+
+// feedStats is the JSON report printed by -stats-only. Only the keys are kept, to
+// count the duplicates.
+type feedStats struct {
+	Source      string         `json:"source"`
+	SourceTime  *time.Time     `json:"source_time,omitempty"` // modification time of the source, if known
+	Bytes       int64          `json:"xml_bytes"`             // uncompressed XML parsed
+	Duration    float64        `json:"duration_seconds"`
+	Records     int            `json:"records"`     // Statistik records read, including rejected ones
+	Plates      int            `json:"plates"`      // distinct keys
+	Duplicates  int            `json:"duplicates"`  // records with a key that was already seen
+	Undecodable int            `json:"undecodable"` // records that failed to decode
+	WithoutKey  int            `json:"without_key"` // records without a key, skipped
+	Fields      map[string]int `json:"fields"`      // records with each field set
+	Makes       map[string]int `json:"makes"`
+	FuelTypes   map[string]int `json:"fuel_types"`
+	Years       map[string]int `json:"first_registration_years"`
+	Categories  map[string]int `json:"categories"` // EU vehicle categories
+	keys        map[string]struct{}
+}
+
+// unknownBucket counts the records without a value in the -stats-only buckets
+const unknownBucket = "(unknown)"
+
+func newFeedStats() *feedStats {
+	return &feedStats{
+		Fields:     make(map[string]int),
+		Makes:      make(map[string]int),
+		FuelTypes:  make(map[string]int),
+		Years:      make(map[string]int),
+		Categories: make(map[string]int),
+		keys:       make(map[string]struct{}),
+	}
+}
+
+// add counts a parsed record with its key, which is empty if it has none
+func (s *feedStats) add(key string, v *Vehicle) {
+	s.Records++
+	if key == "" {
+		s.WithoutKey++
+		return
+	}
+	if _, ok := s.keys[key]; ok {
+		s.Duplicates++
+	} else {
+		s.keys[key] = struct{}{}
+		s.Plates++
+	}
+
+	entry := plateEntry{key, *v}
+	for _, f := range vehicleFields {
+		if f.Value(entry) != "" {
+			s.Fields[f.Name]++
+		}
+	}
+
+	s.Makes[bucketName(v.Make)]++
+	s.FuelTypes[bucketName(v.FuelType)]++
+	s.Years[yearBucket(v.FirstRegistration)]++
+	s.Categories[categoryBucket(v.Category)]++
+}
+
+// categoryBucket is the EU vehicle category as counted by -stats-only and
+// -histograms. Categories are not normalized like makes, as they come from
+// vehicleCategories, but vehicles read with a -mapping may have none.
+func categoryBucket(category string) string {
+	if category == "" {
+		return unknownBucket
+	}
+	return category
+}
+
+// bucketName normalizes a make or fuel type for counting, so that the spellings
+// the feed mixes up count together
+func bucketName(value string) string {
+	value = strings.ToUpper(strings.TrimSpace(value))
+	if value == "" {
+		return unknownBucket
+	}
+	return value
+}
+
+// yearBucket is the year of a first registration date, as counted by -stats-only and
+// -histograms
+func yearBucket(t time.Time) string {
+	if t.IsZero() {
+		return unknownBucket
+	}
+	return strconv.Itoa(t.Year())
+}
+
+// write prints the report as indented JSON
+func (s *feedStats) write(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(s)
+}
+
+// exitExpectationFailed is the exit code used when an -expect-make assertion fails
+const exitExpectationFailed = 5
+
+// makeExpectation is an assertion on the number of vehicles of a make, given as
+// make:<op><count>, e.g. Toyota:>10000
+type makeExpectation struct {
+	Make  string
+	Op    string
+	Count int
+}
+
+// makeOps are the comparisons an expectation can use, longest first so >= is not
+// read as >
+var makeOps = []string{">=", "<=", ">", "<", "="}
+
+func parseMakeExpectation(value string) (makeExpectation, error) {
+	i := strings.LastIndex(value, ":")
+	if i < 0 {
+		return makeExpectation{}, fmt.Errorf("invalid expectation %q: expected make:<op><count>, e.g. Toyota:>10000", value)
+	}
+	e := makeExpectation{Make: strings.TrimSpace(value[:i])}
+	if e.Make == "" {
+		return makeExpectation{}, fmt.Errorf("invalid expectation %q: the make is empty", value)
+	}
+	rest := strings.TrimSpace(value[i+1:])
+	for _, op := range makeOps {
+		if strings.HasPrefix(rest, op) {
+			e.Op = op
+			rest = strings.TrimSpace(strings.TrimPrefix(rest, op))
+			break
+		}
+	}
+	if e.Op == "" {
+		return makeExpectation{}, fmt.Errorf("invalid expectation %q: the count must start with >, >=, <, <= or =", value)
+	}
+	count, err := strconv.Atoi(rest)
+	if err != nil || count < 0 {
+		return makeExpectation{}, fmt.Errorf("invalid expectation %q: %q is not a count", value, rest)
+	}
+	e.Count = count
+	return e, nil
+}
+
+func (e makeExpectation) String() string {
+	return e.Make + ":" + e.Op + strconv.Itoa(e.Count)
+}
+
+// describe formats the expected count for display, e.g. "more than 10000"
+func (e makeExpectation) describe() string {
+	switch e.Op {
+	case ">":
+		return "more than " + strconv.Itoa(e.Count)
+	case ">=":
+		return "at least " + strconv.Itoa(e.Count)
+	case "<":
+		return "fewer than " + strconv.Itoa(e.Count)
+	case "<=":
+		return "at most " + strconv.Itoa(e.Count)
+	}
+	return "exactly " + strconv.Itoa(e.Count)
+}
+
+func (e makeExpectation) holds(count int) bool {
+	switch e.Op {
+	case ">":
+		return count > e.Count
+	case ">=":
+		return count >= e.Count
+	case "<":
+		return count < e.Count
+	case "<=":
+		return count <= e.Count
+	}
+	return count == e.Count
+}
+
+// UnmarshalText lets config files give expectations in the same form as the flag
+func (e *makeExpectation) UnmarshalText(text []byte) error {
+	parsed, err := parseMakeExpectation(string(text))
+	if err != nil {
+		return err
+	}
+	*e = parsed
+	return nil
+}
+
+// makeExpectations collects the repeated -expect-make flags
+type makeExpectations []makeExpectation
+
+func (m makeExpectations) String() string {
+	names := make([]string, len(m))
+	for i, e := range m {
+		names[i] = e.String()
+	}
+	return strings.Join(names, ",")
+}
+
+func (m *makeExpectations) Set(value string) error {
+	e, err := parseMakeExpectation(value)
+	if err != nil {
+		return err
+	}
+	*m = append(*m, e)
+	return nil
+}
+
+// countMakes returns the number of vehicles of each make, keyed by the upper case
+// make, as the feed does not spell makes consistently
+func countMakes(plates map[string]Vehicle) map[string]int {
+	counts := make(map[string]int)
+	for _, vehicle := range plates {
+		counts[strings.ToUpper(strings.TrimSpace(vehicle.Make))]++
+	}
+	return counts
+}
+
+// checkMakeExpectations prints the result of every expectation and returns how many
+// failed. All of them are checked, so a partial feed shows every make it affects.
+func checkMakeExpectations(expectations makeExpectations, plates map[string]Vehicle) int {
+	counts := countMakes(plates)
+	failed := 0
+	fmt.Printf("\n=== Make expectations ===\n")
+	for _, e := range expectations {
+		count := counts[strings.ToUpper(e.Make)]
+		mark := "✓"
+		if !e.holds(count) {
+			mark = "✗"
+			failed++
+		}
+		fmt.Printf("%s %s: %d vehicles (expected %s)\n", mark, e.Make, count, e.describe())
+	}
+	return failed
+}
+
+// scanMapped reads the remaining tokens of a Statistik element up to its end tag and
+// returns the text of each element whose path is in mapping, keyed by the field name it
+// maps to. Paths are the element names below Statistik joined by "/", without namespace
+// prefixes. When an element repeats, its first occurrence is used.
+func scanMapped(nextToken func() (xml.Token, error), mapping map[string]string) (map[string]string, error) {
+	values := make(map[string]string, len(mapping))
+	var path, text []byte
+	var pathLens []int
+
+	for {
+		token, err := nextToken()
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			pathLens = append(pathLens, len(path))
+			if len(path) > 0 {
+				path = append(path, '/')
+			}
+			path = append(path, t.Name.Local...)
+			text = text[:0]
+		case xml.EndElement:
+			if len(pathLens) == 0 {
+				return values, nil
+			}
+			if field, ok := mapping[string(path)]; ok {
+				if _, seen := values[field]; !seen {
+					values[field] = string(text)
+				}
+			}
+			path = path[:pathLens[len(pathLens)-1]]
+			pathLens = pathLens[:len(pathLens)-1]
+			text = text[:0]
+		case xml.CharData:
+			text = append(text, t...)
+		}
+	}
+}
+
+// vehicleFromValues builds a vehicle from field values found by scanMapped
+func vehicleFromValues(values map[string]string, cfg *Config) Vehicle {
+	var vehicle Vehicle
+	for _, f := range vehicleFields {
+		if value, ok := values[f.Name]; ok {
+			f.Set(&vehicle, value, cfg)
+		}
+	}
+	// The mapping has no mass, so types spanning several categories are unclassified
+	if _, ok := values["category"]; !ok && vehicle.Type != "" {
+		vehicle.Category = vehicleCategory(vehicle.Type, 0)
+	}
+	return vehicle
+}
+
+// loadMapping reads a JSON object mapping XML element paths below Statistik to
+// field names, e.g. {"KoeretoejOplysningGrundStruktur/KoeretoejOplysningStelNummer": "vin"}
+func loadMapping(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read mapping: %w", err)
+	}
+
+	var mapping map[string]string
+	if err := json.Unmarshal(data, &mapping); err != nil {
+		return nil, fmt.Errorf("invalid mapping %s: %w", path, err)
+	}
+
+	for elementPath, name := range mapping {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if _, err := lookupField(name); err != nil {
+			return nil, fmt.Errorf("invalid mapping for %s: %w", elementPath, err)
+		}
+		mapping[elementPath] = name
+	}
+	if len(mapping) == 0 {
+		return nil, fmt.Errorf("mapping %s is empty", path)
+	}
+	return mapping, nil
+}
+
+func downloadAndProcess(plates map[string]Vehicle, cfg *Config) error {
+	session, err := newFTPSession(cfg)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	entries, err := session.listSelected()
+	if err != nil {
+		return err
+	}
+
+	var newestZip *ftp.Entry
+	var archives []*ftp.Entry
+	for _, entry := range entries {
+		if isArchive(entry.Name) {
+			archives = append(archives, entry)
+			if newestZip == nil || entry.Time.After(newestZip.Time) {
+				newestZip = entry
+			}
+		}
+	}
+
+	if newestZip == nil {
+		return errNoZipFiles
+	}
+
+	if cfg.Newest > 1 {
+		return downloadAndProcessNewest(session, archives, entries, plates, cfg)
+	}
+
+	return withSnapshot(cfg, newestZip.Name, newestZip.Time, plates, func() error {
+		return downloadAndProcessArchive(session, newestZip, entries, plates, cfg)
+	})
+}
+
+// downloadAndProcessNewest processes the -newest archives into one dataset. They are
+// processed oldest first, so a plate in several of them is merged with -merge as if
+// the newer record came later in the same file. The snapshot is up to date as long
+// as none of the archives is newer than the newest one it was built from.
+func downloadAndProcessNewest(session *ftpSession, archives, listing []*ftp.Entry, plates map[string]Vehicle, cfg *Config) error {
+	sort.SliceStable(archives, func(i, j int) bool {
+		return archives[i].Time.After(archives[j].Time)
+	})
+	if len(archives) > cfg.Newest {
+		archives = archives[:cfg.Newest]
+	} else if len(archives) < cfg.Newest {
+		log.Printf("Warning: -newest %d, but there are only %d archives", cfg.Newest, len(archives))
+	}
+	slices.Reverse(archives)
+
+	names := make([]string, len(archives))
+	for i, entry := range archives {
+		names[i] = entry.Name
+	}
+
+	newest := archives[len(archives)-1]
+	return withSnapshot(cfg, strings.Join(names, ", "), newest.Time, plates, func() error {
+		process := func(i int, entry *ftp.Entry) error {
+			return downloadAndProcessArchive(session, entry, listing, plates, cfg)
+		}
+		if cfg.ParallelDownloads > 1 {
+			downloads, err := downloadParallel(session, archives, listing, cfg)
+			if err != nil {
+				return err
+			}
+			defer func() {
+				for _, download := range downloads {
+					download.remove()
+				}
+			}()
+			process = func(i int, entry *ftp.Entry) error {
+				defer downloads[i].remove()
+				return downloads[i].process(plates, cfg)
+			}
+		}
+
+		for i, entry := range archives {
+			fmt.Printf("\n=== File %d of %d: %s ===\n", i+1, len(archives), entry.Name)
+			before := len(plates)
+			if err := process(i, entry); err != nil {
+				return fmt.Errorf("failed to process %s: %w", entry.Name, err)
+			}
+			fmt.Printf("✓ %s added %d new plates (%d in total)\n", entry.Name, len(plates)-before, len(plates))
+		}
+		return nil
+	})
+}
+
+// downloadParallel downloads the archives -parallel-downloads at a time, and returns
+// the downloads in the same order. Each worker has its own FTP connection, the first
+// one uses session. The progress of all of them is shown on one progressBoard. Once a
+// download failed no further ones are started, and the downloads are removed.
+// Otherwise the caller removes them.
+func downloadParallel(session *ftpSession, archives, listing []*ftp.Entry, cfg *Config) ([]downloadedArchive, error) {
+	board := newProgressBoard(os.Stdout, log.Writer())
+	log.SetOutput(board)
+	defer log.SetOutput(board.log)
+
+	downloads := make([]downloadedArchive, len(archives))
+	errs := make([]error, len(archives))
+	jobs := make(chan int)
+	var failed atomic.Bool
+	var wg sync.WaitGroup
+	for worker := range min(cfg.ParallelDownloads, len(archives)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			workerSession := session
+			if worker > 0 {
+				workerSession = nil
+				defer func() {
+					if workerSession != nil {
+						workerSession.Close()
+					}
+				}()
+			}
+
+			for i := range jobs {
+				if failed.Load() {
+					continue
+				}
+				if workerSession == nil {
+					if workerSession, errs[i] = newFTPSession(cfg); errs[i] != nil {
+						failed.Store(true)
+						continue
+					}
+				}
+				workerSession.board = board
+				downloads[i], errs[i] = downloadArchive(workerSession, archives[i], listing, cfg)
+				workerSession.board = nil
+				if errs[i] != nil {
+					failed.Store(true)
+				}
+			}
+		}()
+	}
+	for i := range archives {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	// Jobs are taken in order, so the downloads skipped after a failure all come
+	// after the one that failed
+	for i, err := range errs {
+		if err != nil {
+			for _, download := range downloads {
+				download.remove()
+			}
+			return nil, fmt.Errorf("failed to download %s: %w", archives[i].Name, err)
+		}
+	}
+	return downloads, nil
+}
+
+// downloadArchive downloads entry, joined with its .z01, .z02, ... parts in listing
+// if it is the last part of a split zip archive. The caller removes the download.
+func downloadArchive(session *ftpSession, entry *ftp.Entry, listing []*ftp.Entry, cfg *Config) (downloadedArchive, error) {
+	parts, err := archiveParts(entry, listing)
+	if err != nil {
+		return downloadedArchive{}, err
+	}
+	if len(parts) > 1 {
+		path, err := downloadSplit(session, parts, cfg)
+		return downloadedArchive{name: entry.Name, path: path}, err
+	}
+
+	session.printf("Downloading: %s (%s, %s)\n", entry.Name, humanizeBytes(int64(entry.Size)), entry.Time.Format(time.RFC3339))
+	return downloadSingle(session, entry, cfg)
+}
+
+// downloadedArchive is a zip or 7z archive downloaded into memory or a temp file
+type downloadedArchive struct {
+	name string // name of the archive on the server, its extension tells the format
+	data []byte // the archive, if it was downloaded into memory
+	path string // the temp file it was downloaded to otherwise
+}
+
+// process processes the plates of the downloaded archive
+func (a downloadedArchive) process(plates map[string]Vehicle, cfg *Config) error {
+	if a.data == nil {
+		return processArchiveFile(a.path, plates, cfg)
+	}
+
+	data := bytes.NewReader(a.data)
+	if strings.ToLower(filepath.Ext(a.name)) == ".7z" {
+		r, err := sevenzip.NewReader(data, data.Size())
+		if err != nil {
+			return fmt.Errorf("failed to open 7z file: %w", err)
+		}
+		return process7zReader(r, plates, cfg)
+	}
+
+	r, err := zip.NewReader(data, data.Size())
+	if err != nil {
+		return fmt.Errorf("failed to open zip file: %w", err)
+	}
+	return processZipReader(r, plates, cfg)
+}
+
+// remove removes the temp file of the download, if it has one
+func (a downloadedArchive) remove() {
+	if a.path != "" {
+		os.Remove(a.path)
+	}
+}
+
+// downloadSingle downloads an archive that is not split into parts. Small archives
+// can skip the round trip through the disk: if the listed size is within -in-memory
+// it is downloaded into memory, so an archive of unknown size uses a temp file. The
+// caller removes the download.
+func downloadSingle(session *ftpSession, entry *ftp.Entry, cfg *Config) (downloadedArchive, error) {
+	archive := downloadedArchive{name: entry.Name}
+
+	// Checked before the temp file is created, so an oversized file cannot fill the disk
+	if cfg.MaxFileSize > 0 && int64(entry.Size) > int64(cfg.MaxFileSize) {
+		return archive, fmt.Errorf("%s is %s, larger than -max-file-size %s", entry.Name, humanizeBytes(int64(entry.Size)), cfg.MaxFileSize)
+	}
+
+	if entry.Size > 0 && int64(entry.Size) <= int64(cfg.InMemory) {
+		buffer := bytes.NewBuffer(make([]byte, 0, entry.Size))
+		reset := func() error {
+			buffer.Reset()
+			return nil
+		}
+		if err := downloadWithRetries(session, entry, buffer, reset, cfg); err != nil {
+			return archive, err
+		}
+		archive.data = buffer.Bytes()
+		return archive, nil
+	}
+
+	// Both formats need random access, but the name decides which reader is used
+	tempFile, err := os.CreateTemp("", "ftp-archive-*"+strings.ToLower(filepath.Ext(entry.Name)))
+	if err != nil {
+		return archive, fmt.Errorf("failed to create temp file: %w", err)
+	}
+	err = downloadWithRetries(session, entry, tempFile, resetFile(tempFile, 0), cfg)
+	if closeErr := tempFile.Close(); err == nil && closeErr != nil {
+		err = fmt.Errorf("failed to write temp file: %w", closeErr)
+	}
+	if err != nil {
+		os.Remove(tempFile.Name())
+		return archive, err
+	}
+	archive.path = tempFile.Name()
+	return archive, nil
+}
+
+// processArchiveFile processes a downloaded zip or 7z file, telling them apart by
+// the extension
+func processArchiveFile(path string, plates map[string]Vehicle, cfg *Config) error {
+	if strings.ToLower(filepath.Ext(path)) == ".7z" {
+		return process7zFile(path, plates, cfg)
+	}
+	return processZipFile(path, plates, cfg)
+}
+
+// downloadAndProcessEntry downloads a zip or 7z file from the registry directory and
+// processes it
+func downloadAndProcessEntry(session *ftpSession, entry *ftp.Entry, plates map[string]Vehicle, cfg *Config) error {
+	fmt.Printf("Downloading: %s (%s)\n", entry.Name, entry.Time.Format(time.RFC3339))
+	fmt.Printf("File size: %s\n", humanizeBytes(int64(entry.Size)))
+
+	if cfg.KeepTmp {
+		return downloadAndProcessKept(session, entry, strings.ToLower(filepath.Ext(entry.Name)), plates, cfg)
+	}
+
+	archive, err := downloadSingle(session, entry, cfg)
+	if err != nil {
+		return err
+	}
+	defer archive.remove()
+	return archive.process(plates, cfg)
+}
+
+// keptDownload is the record written next to a download kept with -keep-tmp. It is
+// only written once the download is complete, so a run that crashed while parsing
+// leaves a file the next run can trust, and one that crashed while downloading does not.
+type keptDownload struct {
+	Name   string    `json:"name"`
+	Size   uint64    `json:"size"`
+	Time   time.Time `json:"time"`
+	SHA256 string    `json:"sha256"`
+}
+
+// keptDir is where -keep-tmp keeps the downloads: OutputDir, so they are shared
+// across runs, or the temp directory
+func keptDir(cfg *Config) string {
+	if cfg.OutputDir != "" {
+		return cfg.OutputDir
+	}
+	return os.TempDir()
+}
+
+// hashFile returns the hex SHA-256 hash of the file at path
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// checkKeptDownload returns nil if the file at path is a complete download of entry:
+// its record names the same remote file with the same size and time, and the file
+// still has the hash it had when it was downloaded. Without a record the error
+// matches os.ErrNotExist.
+func checkKeptDownload(path, recordPath string, entry *ftp.Entry) error {
+	data, err := os.ReadFile(recordPath)
+	if err != nil {
+		return err
+	}
+	var record keptDownload
+	if err := json.Unmarshal(data, &record); err != nil {
+		return fmt.Errorf("invalid record %s: %w", recordPath, err)
+	}
+	if record.Name != entry.Name || record.Size != entry.Size || !record.Time.Equal(entry.Time) {
+		return fmt.Errorf("it is %s (%s, %s), the server has %s (%s, %s)", record.Name, humanizeBytes(int64(record.Size)),
+			record.Time.Format(time.RFC3339), entry.Name, humanizeBytes(int64(entry.Size)), entry.Time.Format(time.RFC3339))
+	}
+
+	sum, err := hashFile(path)
+	if err != nil {
+		return err
+	}
+	if sum != record.SHA256 {
+		return fmt.Errorf("its SHA-256 hash is %s, but was %s when it was downloaded", sum, record.SHA256)
+	}
+	return nil
+}
+
+// downloadAndProcessKept processes the download of entry kept by an earlier run with
+// -keep-tmp if it is still valid, else downloads it again. The download is kept
+// after the run, but split archives and -in-memory downloads are not kept.
+func downloadAndProcessKept(session *ftpSession, entry *ftp.Entry, ext string, plates map[string]Vehicle, cfg *Config) error {
+	if cfg.MaxFileSize > 0 && int64(entry.Size) > int64(cfg.MaxFileSize) {
+		return fmt.Errorf("%s is %s, larger than -max-file-size %s", entry.Name, humanizeBytes(int64(entry.Size)), cfg.MaxFileSize)
+	}
+
+	path := filepath.Join(keptDir(cfg), "autoplate-"+filepath.Base(entry.Name))
+	recordPath := path + ".json"
+
+	process := func() error {
+		if ext == ".7z" {
+			return process7zFile(path, plates, cfg)
+		}
+		return processZipFile(path, plates, cfg)
+	}
+
+	err := checkKeptDownload(path, recordPath, entry)
+	if err == nil {
+		fmt.Printf("✓ Using the download kept in %s, its hash is unchanged\n", path)
+		return process()
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		log.Printf("Warning: not using the download kept in %s: %v", path, err)
+	}
+
+	// Removed first, so the file is not trusted until the download has completed
+	if err := os.Remove(recordPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove the record of the kept download: %w", err)
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create kept download: %w", err)
+	}
+	defer file.Close()
+
+	if err := downloadWithRetries(session, entry, file, resetFile(file, 0), cfg); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to write kept download: %w", err)
+	}
+
+	sum, err := hashFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to hash kept download: %w", err)
+	}
+	data, err := json.MarshalIndent(keptDownload{Name: entry.Name, Size: entry.Size, Time: entry.Time, SHA256: sum}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(recordPath, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write the record of the kept download: %w", err)
+	}
+	fmt.Printf("✓ Kept the download in %s\n", path)
+	return process()
+}
+
+// resetFile returns a reset for downloadWithRetries that discards everything
+// written to file after offset, and continues writing from there
+func resetFile(file *os.File, offset int64) func() error {
+	return func() error {
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			return fmt.Errorf("failed to rewind %s: %w", file.Name(), err)
+		}
+		if err := file.Truncate(offset); err != nil {
+			return fmt.Errorf("failed to truncate %s: %w", file.Name(), err)
+		}
+		return nil
+	}
+}
+
+// downloadWithRetries downloads entry into dst, calling reset to discard what was
+// written before each attempt. A download that stalls is started again on a new
+// connection, and so is one whose size is far off the listed size.
+func downloadWithRetries(session *ftpSession, entry *ftp.Entry, dst io.Writer, reset func() error, cfg *Config) error {
+	// The zip is opened with the size of the downloaded data, not the size reported
+	// in the listing, so a mismatch cannot misalign the reads. But a download that is
+	// far off the listed size is most likely cut off or corrupt, so it is retried.
+	for attempt := 1; ; attempt++ {
+		if err := reset(); err != nil {
+			return err
+		}
+		written, err := downloadEntry(session, entry, dst, cfg)
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() && attempt < maxDownloadAttempts {
+			log.Printf("Warning: download of %s timed out after %s (%v), downloading again (%d/%d)",
+				entry.Name, humanizeBytes(written), err, attempt+1, maxDownloadAttempts)
+			// The server may still be busy with the abandoned transfer, so
+			// its control connection is not reused
+			if err := session.reconnect(); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if session.board != nil {
+			session.board.printf("✓ Downloaded %s (%s)\n", entry.Name, humanizeBytes(written))
+		} else {
+			fmt.Printf("\n✓ Downloaded %s\n", humanizeBytes(written))
+		}
+		if entry.Size == 0 || written == int64(entry.Size) {
+			return nil
+		}
+
+		diff := written - int64(entry.Size)
+		// Exact byte counts, as the difference may be too small to show up scaled
+		log.Printf("Warning: downloaded %d bytes, but the server listed %s as %d bytes (%+d)", written, entry.Name, entry.Size, diff)
+		if float64(max(diff, -diff)) <= downloadSizeTolerance*float64(entry.Size) {
+			return nil
+		}
+		if attempt == maxDownloadAttempts {
+			return fmt.Errorf("download size %d of %s does not match listed size %d after %d attempts", written, entry.Name, entry.Size, attempt)
+		}
+		log.Printf("Warning: size mismatch is more than %.0f%%, downloading again (%d/%d)", downloadSizeTolerance*100, attempt+1, maxDownloadAttempts)
+	}
+}
+
+// downloadAndProcessArchive downloads and processes entry, together with its .z01,
+// .z02, ... parts in listing if it is the last part of a split zip archive
+func downloadAndProcessArchive(session *ftpSession, entry *ftp.Entry, listing []*ftp.Entry, plates map[string]Vehicle, cfg *Config) error {
+	parts, err := archiveParts(entry, listing)
+	if err != nil {
+		return err
+	}
+	if len(parts) > 1 {
+		return downloadAndProcessSplit(session, parts, plates, cfg)
+	}
+	return downloadAndProcessEntry(session, entry, plates, cfg)
+}
+
+// archiveParts returns the .z01, .z02, ... parts of entry in listing followed by
+// entry itself if it is the last part of a split zip archive, else just entry
+func archiveParts(entry *ftp.Entry, listing []*ftp.Entry) ([]*ftp.Entry, error) {
+	names := make([]string, len(listing))
+	byName := make(map[string]*ftp.Entry, len(listing))
+	for i, e := range listing {
+		names[i] = e.Name
+		byName[e.Name] = e
+	}
+	partNames, err := splitPartNames(entry.Name, names)
+	if err != nil {
+		return nil, err
+	}
+
+	parts := make([]*ftp.Entry, 0, len(partNames)+1)
+	for _, name := range partNames {
+		parts = append(parts, byName[name])
+	}
+	return append(parts, entry), nil
+}
+
+// downloadAndProcessSplit downloads the parts of a split zip archive one after the
+// other into a temp file, joins them into one archive and processes it. The last part
+// is the .zip, which holds the central directory.
+func downloadAndProcessSplit(session *ftpSession, parts []*ftp.Entry, plates map[string]Vehicle, cfg *Config) error {
+	path, err := downloadSplit(session, parts, cfg)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(path)
+	return processZipFile(path, plates, cfg)
+}
+
+// downloadSplit downloads the parts of a split zip archive one after the other into
+// a temp file and joins them into one archive, returning the name of the temp file.
+// The caller removes it.
+func downloadSplit(session *ftpSession, parts []*ftp.Entry, cfg *Config) (path string, err error) {
+	name := parts[len(parts)-1].Name
+	var size uint64
+	for _, part := range parts {
+		size += part.Size
+	}
+	session.printf("Downloading: %s, split into %d parts (%s in total)\n", name, len(parts), humanizeBytes(int64(size)))
+
+	if cfg.MaxFileSize > 0 && int64(size) > int64(cfg.MaxFileSize) {
+		return "", fmt.Errorf("%s is %s, larger than -max-file-size %s", name, humanizeBytes(int64(size)), cfg.MaxFileSize)
+	}
+
+	// A split archive is always joined on disk, as the directory is rewritten in place
+	tempFile, err := os.CreateTemp("", "ftp-archive-*.zip")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temp file: %w", err)
+	}
+	defer func() {
+		tempFile.Close()
+		if err != nil {
+			os.Remove(tempFile.Name())
+		}
+	}()
+
+	starts := make([]int64, len(parts))
+	for i, part := range parts {
+		session.printf("Downloading part %d of %d: %s (%s)\n", i+1, len(parts), part.Name, humanizeBytes(int64(part.Size)))
+		start, err := tempFile.Seek(0, io.SeekEnd)
+		if err != nil {
+			return "", fmt.Errorf("failed to seek temp file: %w", err)
+		}
+		starts[i] = start
+		if err := downloadWithRetries(session, part, tempFile, resetFile(tempFile, start), cfg); err != nil {
+			return "", err
+		}
+	}
+
+	if err := joinSplitZip(tempFile, starts); err != nil {
+		return "", fmt.Errorf("failed to join split archive %s: %w", name, err)
+	}
+	return tempFile.Name(), nil
+}
+
+const (
+	// maxDownloadAttempts caps how often a download that stalled or has a wrong
+	// size is retried
+	maxDownloadAttempts = 3
+
+	// downloadSizeTolerance is the fraction of the listed size a download may be
+	// off by before it is considered failed
+	downloadSizeTolerance = 0.01
+)
+
+// downloadEntry retrieves entry into dst and returns the number of bytes written
+func downloadEntry(session *ftpSession, entry *ftp.Entry, dst io.Writer, cfg *Config) (written int64, err error) {
+	span := cfg.startSpan("download", attribute.String("file.name", entry.Name), attribute.Int64("file.size", int64(entry.Size)))
+	defer func() {
+		span.SetAttributes(attribute.Int64("bytes", written))
+		endSpan(span, err)
+	}()
+
+	var resp *ftp.Response
+	err = session.do("Retr", func(conn *ftp.ServerConn) (err error) {
+		resp, err = conn.Retr(entry.Name)
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to retrieve file: %w", err)
+	}
+	defer resp.Close()
+
+	var source io.Reader = resp
+	if cfg.MaxBandwidth > 0 {
+		source = newThrottledReader(resp, cfg.MaxBandwidth)
+	}
+
+	progressReader := &ProgressReader{
+		reader: source,
+		total:  int64(entry.Size),
+	}
+	if session.board != nil {
+		transfer := session.board.add(entry.Name, int64(entry.Size))
+		defer session.board.remove(transfer)
+		progressReader.onProgress = func(current, total int64) {
+			session.board.update(transfer, current, total)
+		}
+	}
+
+	// Network reads are coalesced into writes of the buffer size, which spinning
+	// disks handle much better than the small writes of a plain copy. dst is wrapped
+	// so the buffer cannot hand the copy back to its own ReadFrom.
+	if cfg.CopyBufferSize > 0 {
+		buffered := bufio.NewWriterSize(struct{ io.Writer }{dst}, int(cfg.CopyBufferSize))
+		written, err = io.Copy(buffered, progressReader)
+		if flushErr := buffered.Flush(); err == nil {
+			err = flushErr
+		}
+	} else {
+		written, err = io.Copy(dst, progressReader)
+	}
+	if err != nil {
+		return written, fmt.Errorf("failed to stream file: %w", err)
+	}
+	return written, nil
+}
+
+// plateEntry is a single stored vehicle with its key (the plate unless -key
+// selects another field), used for ordered output
+type plateEntry struct {
+	key     string
+	vehicle Vehicle
+}
+
+// String formats the entry for display as "key - make model", or just the key when
+// make and model are unknown (e.g. with -plates-only), followed by when the plate
+// went missing from the feed with -reconcile
+func (e plateEntry) String() string {
+	s := e.key
+	if makeModel := e.vehicle.MakeModel(); makeModel != "" {
+		s += " - " + makeModel
+	}
+	if !e.vehicle.Inactive.IsZero() {
+		s += " (inactive since " + formatDate(e.vehicle.Inactive) + ")"
+	}
+	return s
+}
+
+// sortedEntries returns all plates ordered by plate
+func sortedEntries(plates map[string]Vehicle) []plateEntry {
+	entries := make([]plateEntry, 0, len(plates))
+	for plate, vehicle := range plates {
+		entries = append(entries, plateEntry{plate, vehicle})
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].key < entries[j].key
+	})
+
+	return entries
+}
+
+// sortByTimestamp orders entries by first registration, newest first; ties and
+// vehicles without a date keep their plate order, with undated vehicles last
+func sortByTimestamp(entries []plateEntry) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].vehicle.FirstRegistration.After(entries[j].vehicle.FirstRegistration)
+	})
+}
+
+// formatTimestamp formats a timestamp for output, leaving unknown times empty
+func formatTimestamp(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+// sortNatural orders entries by the letter prefix of their key, then by the value
+// of the number that follows it, so AB9 comes before AB10 and short personalised
+// plates are not interleaved with the standard ones
+func sortNatural(entries []plateEntry) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		return naturalLess(entries[i].key, entries[j].key)
+	})
+}
+
+// naturalLess compares two plates split into a prefix of non-digits, a number and
+// the rest. The prefixes and the rest are compared as text, the numbers by value.
+// Plates that compare equal this way, like AB01 and AB1, fall back to text order.
+func naturalLess(a, b string) bool {
+	prefixA, numberA, restA := splitPlate(a)
+	prefixB, numberB, restB := splitPlate(b)
+
+	if prefixA != prefixB {
+		return prefixA < prefixB
+	}
+
+	// Numbers are compared without leading zeros by length first, so plates with
+	// long digit runs cannot overflow an integer
+	numberA, numberB = strings.TrimLeft(numberA, "0"), strings.TrimLeft(numberB, "0")
+	if len(numberA) != len(numberB) {
+		return len(numberA) < len(numberB)
+	}
+	if numberA != numberB {
+		return numberA < numberB
+	}
+
+	if restA != restB {
+		return restA < restB
+	}
+	return a < b
+}
+
+// splitPlate splits a plate into its leading non-digits, the digits after them
+// and whatever follows
+func splitPlate(plate string) (prefix, number, rest string) {
+	isDigit := func(r rune) bool { return r >= '0' && r <= '9' }
+
+	start := strings.IndexFunc(plate, isDigit)
+	if start < 0 {
+		return plate, "", ""
+	}
+	end := strings.IndexFunc(plate[start:], func(r rune) bool { return !isDigit(r) })
+	if end < 0 {
+		return plate[:start], plate[start:], ""
+	}
+	return plate[:start], plate[start : start+end], plate[start+end:]
+}
+
+// formatDate formats a date for output, leaving unknown dates empty
+func formatDate(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format("2006-01-02")
+}
+
+// queryRange returns all vehicles with a plate between lo and hi (both inclusive)
+// ordered by plate. The plate is compared whatever the -key is.
+func queryRange(plates map[string]Vehicle, lo, hi string) ([]plateEntry, error) {
+	if lo > hi {
+		return nil, fmt.Errorf("lower bound %q is greater than upper bound %q", lo, hi)
+	}
+
+	var results []plateEntry
+	for key, vehicle := range plates {
+		if vehicle.Plate != "" && vehicle.Plate >= lo && vehicle.Plate <= hi {
+			results = append(results, plateEntry{key, vehicle})
+		}
+	}
+	sortByPlate(results)
+	return results, nil
+}
+
+// sortByPlate orders query results by plate, and by key for vehicles with the same
+// plate
+func sortByPlate(results []plateEntry) {
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].vehicle.Plate != results[j].vehicle.Plate {
+			return results[i].vehicle.Plate < results[j].vehicle.Plate
+		}
+		return results[i].key < results[j].key
+	})
+}
+
+// maxFuzzyResults caps the number of plates returned by queryFuzzy
+const maxFuzzyResults = 100
+
+// queryFuzzy returns the vehicles with a plate within maxDist edits (insert, delete,
+// substitute) of plate, closest first and capped at maxFuzzyResults.
+//
+// This is a full scan of all plates, so it is O(n) in the number of plates. Candidates
+// whose length differs by more than maxDist are skipped without computing the distance,
+// which keeps the common case of same-length plates cheap.
+func queryFuzzy(plates map[string]Vehicle, plate string, maxDist int) []plateEntry {
+	type match struct {
+		entry plateEntry
+		dist  int
+	}
+
+	plateLen := utf8.RuneCountInString(plate)
+	var matches []match
+	for key, vehicle := range plates {
+		candidate := vehicle.Plate
+		lenDiff := utf8.RuneCountInString(candidate) - plateLen
+		if candidate == "" || lenDiff > maxDist || -lenDiff > maxDist {
+			continue
+		}
+		if dist := levenshtein(plate, candidate); dist <= maxDist {
+			matches = append(matches, match{plateEntry{key, vehicle}, dist})
+		}
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].dist != matches[j].dist {
+			return matches[i].dist < matches[j].dist
+		}
+		if a, b := matches[i].entry.vehicle.Plate, matches[j].entry.vehicle.Plate; a != b {
+			return a < b
+		}
+		return matches[i].entry.key < matches[j].entry.key
+	})
+
+	if len(matches) > maxFuzzyResults {
+		log.Printf("Warning: %d fuzzy matches found, showing the closest %d", len(matches), maxFuzzyResults)
+		matches = matches[:maxFuzzyResults]
+	}
+
+	results := make([]plateEntry, len(matches))
+	for i, m := range matches {
+		results[i] = m.entry
+	}
+	return results
+}
+
+const (
+	maxRegexResults = 100              // caps the number of plates returned by queryRegex
+	regexTimeout    = 30 * time.Second // queryRegex stops scanning after this long
+)
+
+// queryRegex returns plates matching pattern ordered by plate, capped at
+// maxRegexResults. The pattern is unanchored, so 777 matches any plate containing 777.
+//
+// This is a full scan of all plates, as a pattern cannot use the plate order. Go
+// regular expressions run in linear time, but a large registry and an expensive
+// pattern can still take a while, so the scan gives up after regexTimeout and
+// returns what it has matched so far.
+func queryRegex(plates map[string]Vehicle, pattern string) ([]plateEntry, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+	}
+
+	log.Printf("Regex query %q is a full scan of %d plates", pattern, len(plates))
+
+	deadline := time.Now().Add(regexTimeout)
+	var results []plateEntry
+	scanned := 0
+	for key, vehicle := range plates {
+		if vehicle.Plate != "" && re.MatchString(vehicle.Plate) {
+			results = append(results, plateEntry{key, vehicle})
+		}
+
+		scanned++
+		if scanned%10000 == 0 && time.Now().After(deadline) {
+			log.Printf("Warning: regex query timed out after %v, only %d of %d plates were scanned",
+				regexTimeout, scanned, len(plates))
+			break
+		}
+	}
+	sortByPlate(results)
+
+	if len(results) > maxRegexResults {
+		log.Printf("Warning: %d regex matches found, showing the first %d", len(results), maxRegexResults)
+		results = results[:maxRegexResults]
+	}
+
+	return results, nil
+}
+
+// queryPrefix returns the vehicles with a plate starting with prefix, ordered by
+// plate. Like queryFuzzy this is a full scan of all plates.
+func queryPrefix(plates map[string]Vehicle, prefix string) []plateEntry {
+	var results []plateEntry
+	for key, vehicle := range plates {
+		if vehicle.Plate != "" && strings.HasPrefix(vehicle.Plate, prefix) {
+			results = append(results, plateEntry{key, vehicle})
+		}
+	}
+	sortByPlate(results)
+	return results
+}
+
+// queryMake returns the vehicles of a make, ordered by plate. The makes are compared
+// like the buckets of -stats-only, ignoring case and surrounding spaces.
+func queryMake(plates map[string]Vehicle, name string) []plateEntry {
+	want := bucketName(name)
+	var results []plateEntry
+	for plate, vehicle := range plates {
+		if bucketName(vehicle.Make) == want {
+			results = append(results, plateEntry{plate, vehicle})
+		}
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].key < results[j].key
+	})
+	return results
+}
+
+// queryInspectionDue returns the vehicles whose last inspection was before the given
+// date, oldest inspection first. The feed only has the date of the last inspection,
+// so "due" means not inspected since before. Vehicles that have never been inspected,
+// like new ones, are left out, as their first inspection depends on the vehicle type.
+//
+// Like queryFuzzy this is a full scan of all plates.
+func queryInspectionDue(plates map[string]Vehicle, before time.Time) []plateEntry {
+	var results []plateEntry
+	uninspected := 0
+	for plate, vehicle := range plates {
+		switch {
+		case vehicle.LastInspection.IsZero():
+			uninspected++
+		default:
+			// Compared as calendar dates, as the feed gives the date in Danish time
+			y, m, d := vehicle.LastInspection.Date()
+			if time.Date(y, m, d, 0, 0, 0, 0, time.UTC).Before(before) {
+				results = append(results, plateEntry{plate, vehicle})
+			}
+		}
+	}
+
+	if uninspected > 0 {
+		log.Printf("Skipped %d vehicles without an inspection date", uninspected)
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		a, b := results[i].vehicle.LastInspection, results[j].vehicle.LastInspection
+		if !a.Equal(b) {
+			return a.Before(b)
+		}
+		return results[i].key < results[j].key
+	})
+
+	return results
+}
+
+// reportRepeatedPlates prints the n plates that occur in most records of the feed,
+// most frequent first. Placeholder or garbage plates in the feed tend to show up
+// here, as they are shared by many records that are otherwise merged into one.
+func reportRepeatedPlates(counts map[string]int, n int) {
+	type repeated struct {
+		plate string
+		count int
+	}
+	var plates []repeated
+	records := 0
+	for plate, count := range counts {
+		records += count
+		if count > 1 {
+			plates = append(plates, repeated{plate, count})
+		}
+	}
+	if records == 0 {
+		fmt.Println("\nNo records were parsed (loaded from a snapshot?), so no repeated plates can be reported")
+		return
+	}
+
+	sort.Slice(plates, func(i, j int) bool {
+		if plates[i].count != plates[j].count {
+			return plates[i].count > plates[j].count
+		}
+		return plates[i].plate < plates[j].plate
+	})
+
+	fmt.Printf("\n=== Most repeated plates (%d of %d plates occur more than once in %d records) ===\n", len(plates), len(counts), records)
+	for i, p := range plates[:min(n, len(plates))] {
+		plate := p.plate
+		if plate == "" {
+			plate = "(empty)"
+		}
+		fmt.Printf("%d. %s: %d records\n", i+1, plate, p.count)
+	}
+}
+
+// platePrefix returns the letters a plate starts with, up to n of them, in upper case
+func platePrefix(plate string, n int) string {
+	letters := 0
+	for i, r := range plate {
+		if letters == n || !unicode.IsLetter(r) {
+			return strings.ToUpper(plate[:i])
+		}
+		letters++
+	}
+	return strings.ToUpper(plate)
+}
+
+// reportPrefixStats prints the number of plates per series, the leading letters of
+// the plate up to n of them, most common first. Plates starting with a digit, like
+// some special plates, are counted under (none).
+func reportPrefixStats(plates map[string]Vehicle, n int) {
+	counts := make(map[string]int)
+	for _, vehicle := range plates {
+		counts[platePrefix(vehicle.Plate, n)]++
+	}
+
+	prefixes := slices.Collect(maps.Keys(counts))
+	sort.Slice(prefixes, func(i, j int) bool {
+		if counts[prefixes[i]] != counts[prefixes[j]] {
+			return counts[prefixes[i]] > counts[prefixes[j]]
+		}
+		return prefixes[i] < prefixes[j]
+	})
+
+	fmt.Printf("\n=== Plates per %d-letter prefix (%d prefixes) ===\n", n, len(prefixes))
+	for _, prefix := range prefixes {
+		count := counts[prefix]
+		if prefix == "" {
+			prefix = "(none)"
+		}
+		fmt.Printf("%-8s %8d  %5.1f%%\n", prefix, count, float64(count)/float64(len(plates))*100)
+	}
+}
+
+// makeAverages sums the known CO2 emissions and kerb weights of the vehicles of a make
+type makeAverages struct {
+	vehicles       int
+	co2Vehicles    int
+	co2            float64
+	weightVehicles int
+	weight         int64
+}
+
+// reportCO2ByMake prints the average CO2 emissions and kerb weight per make, most
+// common make first. Vehicles where a value is unknown (zero) are left out of that
+// average, and the number of vehicles each average is over is shown next to it.
+func reportCO2ByMake(plates map[string]Vehicle) {
+	byMake := make(map[string]*makeAverages)
+	for _, vehicle := range plates {
+		name := bucketName(vehicle.Make)
+		avg := byMake[name]
+		if avg == nil {
+			avg = &makeAverages{}
+			byMake[name] = avg
+		}
+		avg.vehicles++
+		if vehicle.CO2 > 0 {
+			avg.co2Vehicles++
+			avg.co2 += vehicle.CO2
+		}
+		if vehicle.KerbWeight > 0 {
+			avg.weightVehicles++
+			avg.weight += int64(vehicle.KerbWeight)
+		}
+	}
+
+	makes := slices.Collect(maps.Keys(byMake))
+	sort.Slice(makes, func(i, j int) bool {
+		if byMake[makes[i]].vehicles != byMake[makes[j]].vehicles {
+			return byMake[makes[i]].vehicles > byMake[makes[j]].vehicles
+		}
+		return makes[i] < makes[j]
+	})
+
+	fmt.Printf("\n=== CO2 emissions and kerb weight by make (%d makes) ===\n", len(makes))
+	fmt.Printf("%-20s %8s %14s %8s %16s %8s\n", "make", "vehicles", "avg CO2 g/km", "of", "avg weight kg", "of")
+	for _, name := range makes {
+		avg := byMake[name]
+		co2, weight := "-", "-"
+		if avg.co2Vehicles > 0 {
+			co2 = fmt.Sprintf("%.1f", avg.co2/float64(avg.co2Vehicles))
+		}
+		if avg.weightVehicles > 0 {
+			weight = fmt.Sprintf("%.0f", float64(avg.weight)/float64(avg.weightVehicles))
+		}
+		fmt.Printf("%-20s %8d %14s %8d %16s %8d\n", name, avg.vehicles, co2, avg.co2Vehicles, weight, avg.weightVehicles)
+	}
+}
+
+// latestHeap is a min-heap of entries ordered by first registration, so the oldest
+// of the entries kept by queryLatest is at the top and is the one to replace
+type latestHeap []plateEntry
+
+func (h latestHeap) Len() int      { return len(h) }
+func (h latestHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h latestHeap) Less(i, j int) bool {
+	return latestBefore(h[i], h[j])
+}
+func (h *latestHeap) Push(x any) { *h = append(*h, x.(plateEntry)) }
+func (h *latestHeap) Pop() any {
+	old := *h
+	last := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return last
+}
+
+// latestBefore reports whether a ranks after b in queryLatest: registered earlier,
+// or on the same time with a later key, so ties are listed in key order
+func latestBefore(a, b plateEntry) bool {
+	ta, tb := a.vehicle.FirstRegistration, b.vehicle.FirstRegistration
+	if !ta.Equal(tb) {
+		return ta.Before(tb)
+	}
+	return a.key > b.key
+}
+
+// queryLatest returns the n most recently registered vehicles, newest first.
+// Vehicles without a first registration date are left out.
+//
+// The plates are not kept in registration order, so this is a full scan as well,
+// but only the n newest entries are held in a heap instead of sorting all plates.
+func queryLatest(plates map[string]Vehicle, n int) []plateEntry {
+	h := make(latestHeap, 0, n)
+	for plate, vehicle := range plates {
+		if vehicle.FirstRegistration.IsZero() {
+			continue
+		}
+		entry := plateEntry{plate, vehicle}
+		switch {
+		case len(h) < n:
+			heap.Push(&h, entry)
+		case latestBefore(h[0], entry):
+			h[0] = entry
+			heap.Fix(&h, 0)
+		}
+	}
+
+	results := make([]plateEntry, len(h))
+	for i := len(h) - 1; i >= 0; i-- {
+		results[i] = heap.Pop(&h).(plateEntry)
+	}
+	return results
+}
+
+// levenshtein returns the edit distance between a and b
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+
+	return prev[len(rb)]
+}
+
+// displayLimit is the number of plates shown by displaySummary
+const displayLimit = 10
+
+// displaySummary prints displayLimit of the plates in order, for a human to look
+// at: the first ones, the last ones or a random selection, each with its position.
+// The truncation belongs to this summary only. The exports iterate over all
+// plates with exportKeys and never go through it.
+func displaySummary(plates map[string]Vehicle, order, sample string) {
+	// Convert map to sorted slice for display
+	entries := sortedEntries(plates)
+	switch order {
+	case "timestamp":
+		sortByTimestamp(entries)
+	case "natural":
+		sortNatural(entries)
+	}
+
+	fmt.Printf("\n=== License Plates in Database (%d total) ===\n", len(entries))
+	shown := make([]int, 0, displayLimit)
+	switch {
+	case len(entries) <= displayLimit || sample == "head":
+		for i := range min(len(entries), displayLimit) {
+			shown = append(shown, i)
+		}
+	case sample == "tail":
+		for i := len(entries) - displayLimit; i < len(entries); i++ {
+			shown = append(shown, i)
+		}
+	default:
+		picked := make(map[int]bool, displayLimit)
+		for len(picked) < displayLimit {
+			picked[rand.N(len(entries))] = true
+		}
+		shown = slices.Sorted(maps.Keys(picked))
+	}
+
+	if sample == "tail" && len(entries) > displayLimit {
+		fmt.Printf("... %d before these\n", len(entries)-displayLimit)
+	}
+	for _, i := range shown {
+		if order == "timestamp" {
+			fmt.Printf("%d. %s (%s)\n", i+1, entries[i], formatDate(entries[i].vehicle.FirstRegistration))
+		} else {
+			fmt.Printf("%d. %s\n", i+1, entries[i])
+		}
+	}
+
+	if sample == "head" && len(entries) > displayLimit {
+		fmt.Printf("... and %d more\n", len(entries)-displayLimit)
+	} else if sample == "random" && len(entries) > displayLimit {
+		fmt.Printf("... and %d others\n", len(entries)-displayLimit)
+	}
+}
+
+// listedBy formats the title of query results. The results are listed by their
+// key, so the title says so when the -key is not the plate.
+func listedBy(cfg *Config, format string, args ...any) string {
+	title := fmt.Sprintf(format, args...)
+	if cfg.Key != "plate" {
+		title += fmt.Sprintf(", listed by %s", cfg.Key)
+	}
+	return title
+}
+
+func displayQueryResults(title string, results []plateEntry) {
+	fmt.Printf("\n=== %s (%d found) ===\n", title, len(results))
+	for i, entry := range results {
+		fmt.Printf("%d. %s\n", i+1, entry)
+	}
+}
+
+// replMaxResults caps how many plates a -repl command lists
+const replMaxResults = 50
+
+const replHelp = `Commands:
+  get KEY           show all fields of the plate (or -key) KEY
+  prefix PREFIX     list the plates starting with PREFIX
+  range LO HI       list the plates between LO and HI
+  fuzzy PLATE DIST  list the plates within DIST edits of PLATE
+  regex PATTERN     list the plates matching the regular expression
+  make MAKE         list the vehicles of a make
+  latest N          list the N most recently registered vehicles
+  count             show the number of plates
+  help              show this list
+  quit              leave, like exit or the end of the input
+`
+
+// runREPL reads query commands from in, one per line, until quit, exit or the end of
+// the input. A command that fails prints its error, and the next one is read.
+func runREPL(in io.Reader, plates map[string]Vehicle, cfg *Config) error {
+	fmt.Printf("\n%d plates loaded, type help for the commands\n", len(plates))
+	scanner := bufio.NewScanner(in)
+	for {
+		fmt.Print("autoplate> ")
+		if !scanner.Scan() {
+			fmt.Println()
+			return scanner.Err()
+		}
+
+		args := strings.Fields(scanner.Text())
+		if len(args) == 0 {
+			continue
+		}
+		command := strings.ToLower(args[0])
+		if command == "quit" || command == "exit" {
+			return nil
+		}
+		if err := runREPLCommand(command, args[1:], plates, cfg); err != nil {
+			fmt.Printf("Error: %v\n", err)
+		}
+	}
+}
+
+// runREPLCommand runs one -repl command with its arguments
+func runREPLCommand(command string, args []string, plates map[string]Vehicle, cfg *Config) error {
+	usage := func(n int, syntax string) error {
+		if len(args) != n {
+			return fmt.Errorf("usage: %s", syntax)
+		}
+		return nil
+	}
+	plateText := func() error {
+		if cfg.HashPlates {
+			return fmt.Errorf("%s uses the plate text, so it cannot be used with -hash-plates", command)
+		}
+		return nil
+	}
+
+	switch command {
+	case "help":
+		fmt.Print(replHelp)
+
+	case "count":
+		fmt.Printf("%d plates\n", len(plates))
+
+	case "get":
+		if err := usage(1, "get KEY"); err != nil {
+			return err
+		}
+		// Plates are stored as they are in the feed, which is in upper case, but are
+		// often typed in lower case. So the key is looked up as typed first, then in
+		// upper case, and hashed plates are hashed the same way.
+		var key string
+		var vehicle Vehicle
+		ok := false
+		for _, typed := range []string{args[0], strings.ToUpper(args[0])} {
+			key = typed
+			if cfg.HashPlates && cfg.Key == "plate" {
+				key = hashPlate(cfg.HashSalt, typed)
+			}
+			if vehicle, ok = plates[key]; ok {
+				break
+			}
+		}
+		if !ok {
+			return fmt.Errorf("no %s %s", cfg.Key, args[0])
+		}
+		entry := plateEntry{key, vehicle}
+		for _, f := range vehicleFields {
+			if value := f.Value(entry); value != "" {
+				fmt.Printf("  %-17s %s\n", f.Name, value)
+			}
+		}
+
+	case "prefix":
+		if err := usage(1, "prefix PREFIX"); err != nil {
+			return err
+		}
+		if err := plateText(); err != nil {
+			return err
+		}
+		displayREPLResults(listedBy(cfg, "Plates starting with %s", args[0]), queryPrefix(plates, args[0]))
+
+	case "range":
+		if err := usage(2, "range LO HI"); err != nil {
+			return err
+		}
+		if err := plateText(); err != nil {
+			return err
+		}
+		results, err := queryRange(plates, args[0], args[1])
+		if err != nil {
+			return err
+		}
+		displayREPLResults(listedBy(cfg, "Plates between %s and %s", args[0], args[1]), results)
+
+	case "fuzzy":
+		if err := usage(2, "fuzzy PLATE DIST"); err != nil {
+			return err
+		}
+		if err := plateText(); err != nil {
+			return err
+		}
+		dist, err := strconv.Atoi(args[1])
+		if err != nil || dist < 0 {
+			return fmt.Errorf("distance %q must be a non-negative integer", args[1])
+		}
+		displayREPLResults(listedBy(cfg, "Plates within distance %d of %s", dist, args[0]), queryFuzzy(plates, args[0], dist))
+
+	case "regex":
+		if err := usage(1, "regex PATTERN"); err != nil {
+			return err
+		}
+		if err := plateText(); err != nil {
+			return err
+		}
+		results, err := queryRegex(plates, args[0])
+		if err != nil {
+			return err
+		}
+		displayREPLResults(listedBy(cfg, "Plates matching %s", args[0]), results)
+
+	case "make":
+		// Makes can have spaces, like ALFA ROMEO
+		if len(args) == 0 {
+			return fmt.Errorf("usage: make MAKE")
+		}
+		if cfg.PlatesOnly {
+			return fmt.Errorf("-plates-only does not extract makes")
+		}
+		name := strings.Join(args, " ")
+		displayREPLResults(listedBy(cfg, "Vehicles of make %s", name), queryMake(plates, name))
+
+	case "latest":
+		if err := usage(1, "latest N"); err != nil {
+			return err
+		}
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n < 1 {
+			return fmt.Errorf("%q must be a positive integer", args[0])
+		}
+		displayREPLResults(listedBy(cfg, "%d most recently registered vehicles", n), queryLatest(plates, n))
+
+	default:
+		return fmt.Errorf("unknown command %q, type help for the commands", command)
+	}
+	return nil
+}
+
+// displayREPLResults prints query results like displayQueryResults, but only the
+// first replMaxResults of them
+func displayREPLResults(title string, results []plateEntry) {
+	fmt.Printf("\n=== %s (%d found) ===\n", title, len(results))
+	for i, entry := range results[:min(len(results), replMaxResults)] {
+		fmt.Printf("%d. %s\n", i+1, entry)
+	}
+	if len(results) > replMaxResults {
+		fmt.Printf("... and %d more\n", len(results)-replMaxResults)
+	}
+}
+
+// Field is a named column that can be exported for each plate, and set from the
+// text of an XML element when a -mapping is used. Set counts the values it cannot
+// parse in cfg, which can be nil when value is empty.
+type Field struct {
+	Name  string
+	Value func(e plateEntry) string
+	Set   func(v *Vehicle, value string, cfg *Config)
+}
+
+// vehicleFields lists every exportable field in the default column order
+var vehicleFields = []Field{
+	{"plate", func(e plateEntry) string { return e.vehicle.Plate }, func(v *Vehicle, s string, cfg *Config) { v.Plate = s }},
+	{"vin", func(e plateEntry) string { return e.vehicle.VIN }, func(v *Vehicle, s string, cfg *Config) { v.VIN = s }},
+	{"regid", func(e plateEntry) string { return e.vehicle.RegID }, func(v *Vehicle, s string, cfg *Config) { v.RegID = s }},
+	{"make", func(e plateEntry) string { return e.vehicle.Make }, func(v *Vehicle, s string, cfg *Config) { v.Make = s }},
+	{"model", func(e plateEntry) string { return e.vehicle.Model }, func(v *Vehicle, s string, cfg *Config) { v.Model = s }},
+	{"fueltype", func(e plateEntry) string { return e.vehicle.FuelType }, func(v *Vehicle, s string, cfg *Config) { v.FuelType = s }},
+	{"type", func(e plateEntry) string { return e.vehicle.Type }, func(v *Vehicle, s string, cfg *Config) { v.Type = s }},
+	{"category", func(e plateEntry) string { return e.vehicle.Category }, func(v *Vehicle, s string, cfg *Config) { v.Category = s }},
+	{"firstregistration", func(e plateEntry) string { return formatDate(e.vehicle.FirstRegistration) },
+		func(v *Vehicle, s string, cfg *Config) { v.FirstRegistration = parseDate(s, cfg) }},
+	{"statustime", func(e plateEntry) string { return formatTimestamp(e.vehicle.StatusTime) },
+		func(v *Vehicle, s string, cfg *Config) { v.StatusTime = parseDate(s, cfg) }},
+	{"lastinspection", func(e plateEntry) string { return formatDate(e.vehicle.LastInspection) },
+		func(v *Vehicle, s string, cfg *Config) { v.LastInspection = parseDate(s, cfg) }},
+	{"kerbweight", func(e plateEntry) string { return formatNumber(float64(e.vehicle.KerbWeight)) },
+		func(v *Vehicle, s string, cfg *Config) { v.KerbWeight = int(math.Round(parseNumber(s))) }},
+	{"co2", func(e plateEntry) string { return formatNumber(e.vehicle.CO2) },
+		func(v *Vehicle, s string, cfg *Config) { v.CO2 = parseNumber(s) }},
+	{"inactive", func(e plateEntry) string { return formatTimestamp(e.vehicle.Inactive) },
+		func(v *Vehicle, s string, cfg *Config) { v.Inactive = parseDate(s, cfg) }},
+}
+
+func fieldNames(fields []Field) []string {
+	names := make([]string, len(fields))
+	for i, f := range fields {
+		names[i] = f.Name
+	}
+	return names
+}
+
+// lookupField returns the field in vehicleFields with the given name
+func lookupField(name string) (Field, error) {
+	for _, f := range vehicleFields {
+		if f.Name == name {
+			return f, nil
+		}
+	}
+	return Field{}, fmt.Errorf("unknown field %q (known fields: %s)", name, strings.Join(fieldNames(vehicleFields), ", "))
+}
+
+// parseFields resolves a comma-separated list of field names against vehicleFields
+func parseFields(list string) ([]Field, error) {
+	var fields []Field
+	for _, name := range strings.Split(list, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+
+		f, err := lookupField(name)
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, f)
+	}
+
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("no fields selected")
+	}
+	return fields, nil
+}
+
+// exportKeys returns the keys of all plates in export order. Exports stay in plate
+// order with -sort timestamp, only natural order is applied to them. Only the keys
+// are sorted, the exports look up each vehicle as they write it, so they do not
+// hold a second copy of all vehicles. Unlike displaySummary, it never truncates, but
+// with a non-zero since only the keys of the vehicles changed since then are included.
+func exportKeys(plates map[string]Vehicle, order string, since time.Time) []string {
+	keys := slices.Sorted(maps.Keys(plates))
+	if !since.IsZero() {
+		keys = slices.DeleteFunc(keys, func(key string) bool {
+			return recordTime(plates[key]).Before(since)
+		})
+	}
+	if order == "natural" {
+		sort.SliceStable(keys, func(i, j int) bool {
+			return naturalLess(keys[i], keys[j])
+		})
+	}
+	return keys
+}
+
+// csvRowWriter is the part of csv.Writer the CSV export uses, so it can also write
+// through a quotingWriter
+type csvRowWriter interface {
+	Write(record []string) error
+	Flush()
+	Error() error
+}
+
+// quotingWriter writes CSV rows like csv.Writer, but quotes every field. csv.Writer
+// only quotes the fields that need it, and cannot be told otherwise.
+type quotingWriter struct {
+	w     *bufio.Writer
+	comma rune
+	err   error
+}
+
+func (q *quotingWriter) Write(record []string) error {
+	for i, field := range record {
+		if i > 0 {
+			q.w.WriteRune(q.comma)
+		}
+		q.w.WriteByte('"')
+		q.w.WriteString(strings.ReplaceAll(field, `"`, `""`))
+		q.w.WriteByte('"')
+	}
+	// The bufio.Writer keeps the first error and fails every later write with it
+	_, err := q.w.WriteString("\n")
+	return err
+}
+
+func (q *quotingWriter) Flush() {
+	q.err = q.w.Flush()
+}
+
+func (q *quotingWriter) Error() error {
+	return q.err
+}
+
+// exportCSV writes the -fields of all plates in -sort order to path. With -append
+// the rows are added to the end of an existing file after a "# run" comment line,
+// and the header is only written when the file is new or empty. The rows are
+// flushed to the file every -export-flush rows. The fields are separated by the
+// -csv-delim character, and with -csv-quote-all every field is quoted.
+func exportCSV(path string, plates map[string]Vehicle, cfg *Config) error {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if cfg.Append {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+
+	file, err := os.OpenFile(path, flags, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open CSV file: %w", err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat CSV file: %w", err)
+	}
+
+	var w csvRowWriter
+	if cfg.CSVQuoteAll {
+		w = &quotingWriter{w: bufio.NewWriter(file), comma: cfg.csvComma}
+	} else {
+		cw := csv.NewWriter(file)
+		cw.Comma = cfg.csvComma
+		w = cw
+	}
+	if info.Size() == 0 {
+		if err := w.Write(fieldNames(cfg.Fields)); err != nil {
+			return fmt.Errorf("failed to write CSV header: %w", err)
+		}
+	}
+
+	if cfg.Append {
+		// Written directly since csv.Writer would quote a field starting with '#'
+		w.Flush()
+		if _, err := fmt.Fprintf(file, "# run %s\n", time.Now().Format(time.RFC3339)); err != nil {
+			return fmt.Errorf("failed to write run delimiter: %w", err)
+		}
+	}
+
+	row := make([]string, len(cfg.Fields))
+	keys := exportKeys(plates, cfg.Sort, cfg.exportedSince)
+	for n, key := range keys {
+		entry := plateEntry{key, plates[key]}
+		for i, f := range cfg.Fields {
+			row[i] = f.Value(entry)
+		}
+		if err := w.Write(row); err != nil {
+			return fmt.Errorf("failed to write CSV row: %w", err)
+		}
+
+		if (n+1)%cfg.ExportFlush == 0 {
+			w.Flush()
+			if err := w.Error(); err != nil {
+				return fmt.Errorf("failed to write CSV file: %w", err)
+			}
+		}
+	}
+
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return fmt.Errorf("failed to write CSV file: %w", err)
+	}
+
+	fmt.Printf("\n✓ Exported %d plates to %s\n", len(keys), path)
+	return file.Close()
+}
+
+// parquetRow is the schema of the Parquet export. Unlike the CSV export it always
+// has all fields, and dates are stored as dates rather than text.
+type parquetRow struct {
+	Plate             string   `parquet:"plate"`
+	VIN               string   `parquet:"vin"`
+	RegID             string   `parquet:"regid"`
+	Make              string   `parquet:"make"`
+	Model             string   `parquet:"model"`
+	FuelType          string   `parquet:"fueltype"`
+	Type              string   `parquet:"type"`
+	Category          string   `parquet:"category"`
+	FirstRegistration *int32   `parquet:"firstregistration,date,optional"` // days since 1970-01-01
+	StatusTime        *int64   `parquet:"statustime,timestamp(millisecond),optional"`
+	LastInspection    *int32   `parquet:"lastinspection,date,optional"`
+	KerbWeight        *int32   `parquet:"kerbweight,optional"` // kg
+	CO2               *float64 `parquet:"co2,optional"`        // g/km
+	Inactive          *int64   `parquet:"inactive,timestamp(millisecond),optional"`
+}
+
+// parquetDate converts a date to days since 1970-01-01, nil for the zero time. The
+// writer does not convert a time.Time to a date itself. The date is taken as written
+// in the feed, whatever its time zone.
+func parquetDate(t time.Time) *int32 {
+	if t.IsZero() {
+		return nil
+	}
+	y, m, d := t.Date()
+	days := int32(time.Date(y, m, d, 0, 0, 0, 0, time.UTC).Unix() / 86400)
+	return &days
+}
+
+// exportParquet writes all plates to a Parquet file in the same order as the CSV
+// export. Every flushRows rows are written as a row group, so the writer only
+// buffers one group at a time, and keeps a footer entry for each written group
+// until it is closed.
+func exportParquet(path string, plates map[string]Vehicle, order string, since time.Time, flushRows int) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create Parquet file: %w", err)
+	}
+	defer file.Close()
+
+	w := parquet.NewGenericWriter[parquetRow](file, parquet.MaxRowsPerRowGroup(int64(flushRows)))
+	rows := make([]parquetRow, 0, flushRows)
+	flush := func() error {
+		if _, err := w.Write(rows); err != nil {
+			return fmt.Errorf("failed to write Parquet rows: %w", err)
+		}
+		if err := w.Flush(); err != nil {
+			return fmt.Errorf("failed to write Parquet row group: %w", err)
+		}
+		rows = rows[:0]
+		return nil
+	}
+
+	keys := exportKeys(plates, order, since)
+	for _, key := range keys {
+		v := plates[key]
+		row := parquetRow{
+			Plate:    v.Plate,
+			VIN:      v.VIN,
+			RegID:    v.RegID,
+			Make:     v.Make,
+			Model:    v.Model,
+			FuelType: v.FuelType,
+			Type:     v.Type,
+			Category: v.Category,
+		}
+		row.FirstRegistration = parquetDate(v.FirstRegistration)
+		row.LastInspection = parquetDate(v.LastInspection)
+		if v.KerbWeight != 0 {
+			weight := int32(v.KerbWeight)
+			row.KerbWeight = &weight
+		}
+		if v.CO2 != 0 {
+			co2 := v.CO2
+			row.CO2 = &co2
+		}
+		if !v.StatusTime.IsZero() {
+			millis := v.StatusTime.UnixMilli()
+			row.StatusTime = &millis
+		}
+		if !v.Inactive.IsZero() {
+			millis := v.Inactive.UnixMilli()
+			row.Inactive = &millis
+		}
+
+		rows = append(rows, row)
+		if len(rows) == flushRows {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("failed to write Parquet file: %w", err)
+	}
+
+	fmt.Printf("\n✓ Exported %d plates to %s\n", len(keys), path)
+	return file.Close()
+}
+
+// bucketOf returns the bucket a date falls in: the date itself, the Monday of its
+// week or its month
+func bucketOf(t time.Time, bucket string) string {
+	switch bucket {
+	case "week":
+		offset := (int(t.Weekday()) + 6) % 7
+		return t.AddDate(0, 0, -offset).Format("2006-01-02")
+	case "month":
+		return t.Format("2006-01")
+	}
+	return t.Format("2006-01-02")
+}
+
+// timeSeriesPoint is one row of the time series export
+type timeSeriesPoint struct {
+	Date  string `json:"date"`
+	Count int    `json:"count"`
+}
+
+// exportTimeSeries counts the vehicles by the bucket of their first registration
+// date in a single pass over the plates, and writes the counts in date order.
+// Vehicles without a first registration date are left out.
+func exportTimeSeries(path string, plates map[string]Vehicle, bucket string) error {
+	counts := make(map[string]int)
+	undated := 0
+	for _, vehicle := range plates {
+		if vehicle.FirstRegistration.IsZero() {
+			undated++
+			continue
+		}
+		counts[bucketOf(vehicle.FirstRegistration, bucket)]++
+	}
+
+	points := make([]timeSeriesPoint, 0, len(counts))
+	for _, date := range slices.Sorted(maps.Keys(counts)) {
+		points = append(points, timeSeriesPoint{date, counts[date]})
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create time series file: %w", err)
+	}
+	defer file.Close()
+
+	if strings.HasSuffix(strings.ToLower(path), ".json") {
+		encoder := json.NewEncoder(file)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(points); err != nil {
+			return fmt.Errorf("failed to write time series: %w", err)
+		}
+	} else {
+		w := csv.NewWriter(file)
+		w.Write([]string{"date", "count"})
+		for _, point := range points {
+			w.Write([]string{point.Date, strconv.Itoa(point.Count)})
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			return fmt.Errorf("failed to write time series: %w", err)
+		}
+	}
+
+	if undated > 0 {
+		log.Printf("Left %d vehicles without a first registration date out of the time series", undated)
+	}
+	fmt.Printf("\n✓ Exported %d %ss to %s\n", len(points), bucket, path)
+	return file.Close()
+}
+
+// exportPlateVINMap writes plate,vin rows for the vehicles that have both, in the
+// same order as the CSV export, flushing every flushRows rows, and reports how many
+// were skipped
+func exportPlateVINMap(path string, plates map[string]Vehicle, order string, since time.Time, flushRows int) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create plate to VIN map: %w", err)
+	}
+	defer file.Close()
+
+	w := csv.NewWriter(file)
+	w.Write([]string{"plate", "vin"})
+	written, skipped := 0, 0
+	for _, key := range exportKeys(plates, order, since) {
+		v := plates[key]
+		if v.Plate == "" || v.VIN == "" {
+			skipped++
+			continue
+		}
+		w.Write([]string{v.Plate, v.VIN})
+
+		written++
+		if written%flushRows == 0 {
+			w.Flush()
+			if err := w.Error(); err != nil {
+				return fmt.Errorf("failed to write plate to VIN map: %w", err)
+			}
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return fmt.Errorf("failed to write plate to VIN map: %w", err)
+	}
+
+	if skipped > 0 {
+		log.Printf("Left %d vehicles without a plate or VIN out of the plate to VIN map", skipped)
+	}
+	fmt.Printf("\n✓ Exported %d plate to VIN pairs to %s\n", written, path)
+	return file.Close()
+}
+
+// exportPlatesTxt writes the distinct plates to a text file, one per line, in the
+// same order as the CSV export. Keyed on the plate, the sorted keys are already
+// distinct, so the plates are written as they are looked up. With another -key,
+// several vehicles can have the same plate, so the plates are collected, sorted
+// and deduplicated first. Vehicles without a plate are left out.
+func exportPlatesTxt(path string, plates map[string]Vehicle, key, order string, since time.Time, flushRows int) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create plates file: %w", err)
+	}
+	defer file.Close()
+
+	keys := exportKeys(plates, order, since)
+	plateOf := func(key string) string { return plates[key].Plate }
+	if key != "plate" {
+		list := make([]string, 0, len(keys))
+		for _, key := range keys {
+			if plate := plates[key].Plate; plate != "" {
+				list = append(list, plate)
+			}
+		}
+		slices.Sort(list)
+		if order == "natural" {
+			sort.SliceStable(list, func(i, j int) bool {
+				return naturalLess(list[i], list[j])
+			})
+		}
+		keys = slices.Compact(list)
+		plateOf = func(plate string) string { return plate }
+	}
+
+	w := bufio.NewWriter(file)
+	written := 0
+	for _, key := range keys {
+		plate := plateOf(key)
+		if plate == "" {
+			continue
+		}
+		w.WriteString(plate)
+		w.WriteByte('\n')
+
+		written++
+		if written%flushRows == 0 {
+			if err := w.Flush(); err != nil {
+				return fmt.Errorf("failed to write plates file: %w", err)
+			}
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("failed to write plates file: %w", err)
+	}
+
+	fmt.Printf("\n✓ Exported %d plates to %s\n", written, path)
+	return file.Close()
+}
+
+// Problems reported by validatePlate. A plate with an invalidFormat cannot be a
+// Danish plate at all, an implausible one has a valid format but could not have
+// been issued.
+const (
+	invalidFormat = "format"
+	implausible   = "implausible"
+)
+
+// validatePlate checks a plate against the structure of Danish plates and returns
+// the problem and the reason it was found, or empty strings for a valid plate.
+// Danish plates have no check digit, so only the structure can be checked:
+//   - a plate has 2 to 7 letters (A to Z, Æ, Ø, Å) and digits, spaces are ignored
+//   - every plate has at least one letter, only digits is implausible
+//   - a regular plate has two letters from A to Z and a number from 10000 to 99999,
+//     so such a plate with Æ, Ø, Å or a number starting with 0 is implausible
+//
+// Other layouts are left alone, as personalized plates can have any of them.
+func validatePlate(plate string) (problem, reason string) {
+	plate = strings.ToUpper(strings.ReplaceAll(plate, " ", ""))
+	n := utf8.RuneCountInString(plate)
+	if n < 2 || n > 7 {
+		return invalidFormat, fmt.Sprintf("is %d characters long, not 2 to 7", n)
+	}
+
+	letters, digits := 0, 0
+	for _, r := range plate {
+		switch {
+		case r >= 'A' && r <= 'Z', r == 'Æ', r == 'Ø', r == 'Å':
+			letters++
+		case r >= '0' && r <= '9':
+			digits++
+		default:
+			return invalidFormat, fmt.Sprintf("contains %q", r)
+		}
+	}
+	if letters == 0 {
+		return implausible, "has no letters"
+	}
+
+	runes := []rune(plate)
+	if n == 7 && letters == 2 && unicode.IsLetter(runes[0]) && unicode.IsLetter(runes[1]) {
+		if runes[0] > 'Z' || runes[1] > 'Z' {
+			return implausible, "regular series with Æ, Ø or Å"
+		}
+		if runes[2] == '0' {
+			return implausible, "regular number below 10000"
+		}
+	}
+	return "", ""
+}
+
+// exportInvalidPlates writes the plates that fail validatePlate as plate,vin,problem,reason
+// rows, in the same order as the CSV export, flushing every flushRows rows, and reports
+// how many had each problem. Records without a plate are not checked.
+func exportInvalidPlates(path string, plates map[string]Vehicle, order string, since time.Time, flushRows int) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create invalid plates file: %w", err)
+	}
+	defer file.Close()
+
+	w := csv.NewWriter(file)
+	w.Write([]string{"plate", "vin", "problem", "reason"})
+	counts := make(map[string]int)
+	checked, written := 0, 0
+	for _, key := range exportKeys(plates, order, since) {
+		v := plates[key]
+		if v.Plate == "" {
+			continue
+		}
+		checked++
+		problem, reason := validatePlate(v.Plate)
+		if problem == "" {
+			continue
+		}
+		counts[problem]++
+		w.Write([]string{v.Plate, v.VIN, problem, reason})
+
+		written++
+		if written%flushRows == 0 {
+			w.Flush()
+			if err := w.Error(); err != nil {
+				return fmt.Errorf("failed to write invalid plates: %w", err)
+			}
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return fmt.Errorf("failed to write invalid plates: %w", err)
+	}
+
+	fmt.Printf("\n✓ Checked %d plates: %d with an invalid format and %d implausible, exported to %s\n",
+		checked, counts[invalidFormat], counts[implausible], path)
+	return file.Close()
+}
+
+// otherBucket collects the -histograms buckets with fewer than -k-anonymity vehicles.
+// It is lower case, so it cannot be confused with an upper-cased make.
+const otherBucket = "other"
+
+// histogramBucket is one count of the histograms export
+type histogramBucket struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+// histograms is the histograms export, with the buckets of each dimension ordered by
+// count, and otherBucket last
+type histograms struct {
+	K          int                          `json:"k"`
+	Vehicles   int                          `json:"vehicles"`
+	Dimensions map[string][]histogramBucket `json:"histograms"`
+}
+
+// suppressBuckets merges the buckets with fewer than k vehicles into otherBucket. If
+// that leaves otherBucket itself below k, the smallest remaining buckets are merged
+// into it too, so every published count is of at least k vehicles (unless all of
+// them together are fewer) and none can be worked out from the others.
+func suppressBuckets(counts map[string]int, k int) []histogramBucket {
+	buckets := make([]histogramBucket, 0, len(counts))
+	for value, count := range counts {
+		buckets = append(buckets, histogramBucket{value, count})
+	}
+	sort.Slice(buckets, func(i, j int) bool {
+		if buckets[i].Count != buckets[j].Count {
+			return buckets[i].Count > buckets[j].Count
+		}
+		return buckets[i].Value < buckets[j].Value
+	})
+
+	other := 0
+	for len(buckets) > 0 && buckets[len(buckets)-1].Count < k {
+		other += buckets[len(buckets)-1].Count
+		buckets = buckets[:len(buckets)-1]
+	}
+	for other > 0 && other < k && len(buckets) > 0 {
+		other += buckets[len(buckets)-1].Count
+		buckets = buckets[:len(buckets)-1]
+	}
+	if other > 0 {
+		buckets = append(buckets, histogramBucket{otherBucket, other})
+	}
+	return buckets
 }
 
-type KoeretoejBetegnelseStruktur struct {
-	KoeretoejMaerkeTypeNavn string `xml:"KoeretoejMaerkeTypeNavn"`
-	Model                   Model  `xml:"Model"`
+// exportHistograms counts the vehicles per make, fuel type and year of first
+// registration, and writes the counts after merging the buckets below k. Only the
+// counts are written, nothing that identifies a vehicle.
+func exportHistograms(path string, plates map[string]Vehicle, k int) error {
+	makes := make(map[string]int)
+	fuelTypes := make(map[string]int)
+	years := make(map[string]int)
+	categories := make(map[string]int)
+	for _, vehicle := range plates {
+		makes[bucketName(vehicle.Make)]++
+		fuelTypes[bucketName(vehicle.FuelType)]++
+		years[yearBucket(vehicle.FirstRegistration)]++
+		categories[categoryBucket(vehicle.Category)]++
+	}
+
+	export := histograms{K: k, Vehicles: len(plates), Dimensions: map[string][]histogramBucket{
+		"make":                    suppressBuckets(makes, k),
+		"fuel_type":               suppressBuckets(fuelTypes, k),
+		"first_registration_year": suppressBuckets(years, k),
+		"category":                suppressBuckets(categories, k),
+	}}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create histograms file: %w", err)
+	}
+	defer file.Close()
+
+	if strings.HasSuffix(strings.ToLower(path), ".json") {
+		encoder := json.NewEncoder(file)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(export); err != nil {
+			return fmt.Errorf("failed to write histograms: %w", err)
+		}
+	} else {
+		w := csv.NewWriter(file)
+		w.Write([]string{"dimension", "value", "count"})
+		for _, dimension := range slices.Sorted(maps.Keys(export.Dimensions)) {
+			for _, bucket := range export.Dimensions[dimension] {
+				w.Write([]string{dimension, bucket.Value, strconv.Itoa(bucket.Count)})
+			}
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			return fmt.Errorf("failed to write histograms: %w", err)
+		}
+	}
+
+	suppressed := 0
+	for _, buckets := range export.Dimensions {
+		if n := len(buckets); n > 0 && buckets[n-1].Value == otherBucket {
+			suppressed++
+		}
+	}
+	fmt.Printf("\n✓ Exported the histograms of %d vehicles to %s (%d of %d with an %q bucket)\n", len(plates), path, suppressed, len(export.Dimensions), otherBucket)
+	return file.Close()
 }
 
-type Model struct {
-	KoeretoejModelTypeNavn string `xml:"KoeretoejModelTypeNavn"`
+// Records are published to a -sink in batches of sinkBatchSize. At most sinkQueueSize
+// records wait to be published, once the queue is full parsing waits for the broker,
+// so a slow broker slows the run down instead of filling the memory.
+const (
+	sinkBatchSize = 1000
+	sinkQueueSize = 10 * sinkBatchSize
+
+	// maxSinkWarnings caps the failed batches that are logged
+	maxSinkWarnings = 10
+
+	// natsFlushTimeout bounds waiting for the NATS server to take a batch
+	natsFlushTimeout = 30 * time.Second
+)
+
+// sinkMessage is a record published to a -sink, keyed on the record key
+type sinkMessage struct {
+	key   string
+	value []byte
 }
 
-// ProgressReader wraps an io.Reader and reports progress
-type ProgressReader struct {
-	reader    io.Reader
-	total     int64
-	current   int64
-	lastPrint int64
+// publisher sends batches of records to a message broker
+type publisher interface {
+	publish(batch []sinkMessage) error
+	Close() error
 }
 
-func (pr *ProgressReader) Read(p []byte) (int, error) {
-	n, err := pr.reader.Read(p)
-	pr.current += int64(n)
+// recordSink publishes records to a message broker as JSON objects of the -fields
+// columns. Records are queued and published from a goroutine of its own. A batch
+// that cannot be published is counted and logged, but does not fail the run.
+type recordSink struct {
+	name      string // URL without the password, for the log
+	fields    []Field
+	publisher publisher
+	queue     chan sinkMessage
+	done      chan struct{}
+	published int
+	failed    int
+	warnings  int
+}
 
-	if pr.total > 0 {
-		percentDone := (pr.current * 100) / pr.total
-		if percentDone > pr.lastPrint {
-			pr.lastPrint = percentDone
-			fmt.Printf("\rDownloading: %d%% (%d / %d bytes)", percentDone, pr.current, pr.total)
+// parseSinkURL checks a -sink URL, returning the broker addresses, with the default
+// port for the scheme added to hosts given without one, and the topic
+func parseSinkURL(raw string) (*url.URL, []string, string, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	var port string
+	switch u.Scheme {
+	case "kafka":
+		port = "9092"
+	case "nats":
+		port = "4222"
+	default:
+		return nil, nil, "", fmt.Errorf("%q must start with kafka:// or nats://", u.Redacted())
+	}
+
+	topic := strings.Trim(u.Path, "/")
+	if topic == "" {
+		return nil, nil, "", fmt.Errorf("%q has no topic, e.g. %s://localhost:%s/plates", u.Redacted(), u.Scheme, port)
+	}
+
+	var brokers []string
+	for _, host := range strings.Split(u.Host, ",") {
+		if host == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			host = net.JoinHostPort(host, port)
+		}
+		brokers = append(brokers, host)
+	}
+	if len(brokers) == 0 {
+		return nil, nil, "", fmt.Errorf("%q has no broker address", u.Redacted())
+	}
+	return u, brokers, topic, nil
+}
+
+// openSink connects to the broker of the -sink and starts publishing
+func openSink(cfg *Config) (*recordSink, error) {
+	u, brokers, topic, err := parseSinkURL(cfg.Sink)
+	if err != nil {
+		return nil, err
+	}
+
+	var p publisher
+	switch u.Scheme {
+	case "kafka":
+		p = newKafkaPublisher(brokers, topic)
+	case "nats":
+		if p, err = newNATSPublisher(u, brokers, topic, cfg.ConnectTimeout); err != nil {
+			return nil, err
 		}
 	}
 
-	return n, err
+	s := &recordSink{
+		name:      u.Redacted(),
+		fields:    cfg.Fields,
+		publisher: p,
+		queue:     make(chan sinkMessage, sinkQueueSize),
+		done:      make(chan struct{}),
+	}
+	go s.run()
+	return s, nil
 }
 
-func main() {
-	fileInput := flag.String("file", "", "Path to local XML or ZIP file (if not provided, downloads from FTP)")
-	flag.Parse()
+// add queues a record for publishing, waiting while the queue is full
+func (s *recordSink) add(key string, vehicle Vehicle) {
+	entry := plateEntry{key, vehicle}
+	values := make(map[string]string, len(s.fields))
+	for _, f := range s.fields {
+		values[f.Name] = f.Value(entry)
+	}
+	// Marshalling a map of strings cannot fail
+	value, _ := json.Marshal(values)
+	s.queue <- sinkMessage{key, value}
+}
 
-	// Use simple map instead of memdb
-	plates := make(map[string]string, 100000) // Pre-allocate with estimated capacity
+// run publishes the queued records. A batch is sent once it is full or the queue is
+// empty, so records are not held back while parsing is slower than the broker.
+func (s *recordSink) run() {
+	defer close(s.done)
 
-	if *fileInput != "" {
-		log.Printf("Using local file: %s\n", *fileInput)
-		if err := processLocalFile(*fileInput, plates); err != nil {
-			log.Fatalf("Error processing local file: %v", err)
+	batch := make([]sinkMessage, 0, sinkBatchSize)
+	send := func() {
+		if err := s.publisher.publish(batch); err != nil {
+			s.failed += len(batch)
+			s.warnings++
+			if s.warnings <= maxSinkWarnings {
+				log.Printf("Warning: failed to publish %d records to %s: %v", len(batch), s.name, err)
+			}
+			if s.warnings == maxSinkWarnings {
+				log.Printf("Warning: not logging further publish failures")
+			}
+		} else {
+			s.published += len(batch)
 		}
-	} else {
-		log.Println("No file specified, downloading from FTP server...")
-		if err := downloadAndProcess(plates); err != nil {
-			log.Fatalf("Error downloading and processing: %v", err)
+		batch = batch[:0]
+	}
+
+	for message := range s.queue {
+		batch = append(batch, message)
+		if len(batch) == sinkBatchSize || len(s.queue) == 0 {
+			send()
 		}
 	}
+	if len(batch) > 0 {
+		send()
+	}
+}
+
+// Close publishes the remaining records, disconnects and reports how many records
+// were published
+func (s *recordSink) Close() error {
+	close(s.queue)
+	<-s.done
+	err := s.publisher.Close()
 
-	displayResults(plates)
+	fmt.Printf("\n✓ Published %d records to %s\n", s.published, s.name)
+	if s.failed > 0 {
+		log.Printf("Warning: %d records could not be published to %s", s.failed, s.name)
+	}
+	return err
 }
 
-func processLocalFile(filePath string, plates map[string]string) error {
-	ext := strings.ToLower(filePath[len(filePath)-4:])
+// kafkaPublisher publishes to a Kafka topic, partitioned by the record key so all
+// records of a key end up in the same partition
+type kafkaPublisher struct {
+	writer *kafka.Writer
+}
 
-	switch ext {
-	case ".xml":
-		file, err := os.Open(filePath)
-		if err != nil {
-			return fmt.Errorf("failed to open XML file: %w", err)
-		}
-		defer file.Close()
+func newKafkaPublisher(brokers []string, topic string) *kafkaPublisher {
+	return &kafkaPublisher{writer: &kafka.Writer{
+		Addr:         kafka.TCP(brokers...),
+		Topic:        topic,
+		Balancer:     &kafka.Hash{},
+		BatchSize:    sinkBatchSize,
+		BatchTimeout: 10 * time.Millisecond, // batches are formed by recordSink already
+		RequiredAcks: kafka.RequireOne,
+	}}
+}
 
-		count, err := streamXML(file, plates)
-		if err != nil {
+func (p *kafkaPublisher) publish(batch []sinkMessage) error {
+	messages := make([]kafka.Message, len(batch))
+	for i, m := range batch {
+		messages[i] = kafka.Message{Key: []byte(m.key), Value: m.value}
+	}
+	return p.writer.WriteMessages(context.Background(), messages...)
+}
+
+func (p *kafkaPublisher) Close() error {
+	return p.writer.Close()
+}
+
+// natsPublisher publishes to a NATS subject, with the record key in the Key header
+type natsPublisher struct {
+	conn    *nats.Conn
+	subject string
+}
+
+func newNATSPublisher(u *url.URL, servers []string, subject string, timeout time.Duration) (*natsPublisher, error) {
+	// Without a reconnect buffer, records fail right away while the connection is
+	// down, instead of each batch waiting for the flush timeout
+	options := []nats.Option{nats.Name("autoplate"), nats.Timeout(timeout), nats.ReconnectBufSize(-1)}
+	if u.User != nil {
+		password, _ := u.User.Password()
+		options = append(options, nats.UserInfo(u.User.Username(), password))
+	}
+	for i, server := range servers {
+		servers[i] = "nats://" + server
+	}
+
+	conn, err := nats.Connect(strings.Join(servers, ","), options...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to NATS: %w", err)
+	}
+	return &natsPublisher{conn: conn, subject: subject}, nil
+}
+
+// publish hands the batch to the client and waits until the server has it, so the
+// client's buffer cannot grow without bounds while the server falls behind
+func (p *natsPublisher) publish(batch []sinkMessage) error {
+	for _, m := range batch {
+		msg := &nats.Msg{Subject: p.subject, Data: m.value, Header: nats.Header{"Key": {m.key}}}
+		if err := p.conn.PublishMsg(msg); err != nil {
 			return err
 		}
+	}
+	return p.conn.FlushTimeout(natsFlushTimeout)
+}
 
-		fmt.Printf("\n✓ Successfully processed %d license plates\n", count)
-		return nil
+func (p *natsPublisher) Close() error {
+	defer p.conn.Close()
+	return p.conn.FlushTimeout(natsFlushTimeout)
+}
 
-	case ".zip":
-		return processZipFile(filePath, plates)
+// readManifest returns the file names listed in a manifest, one per line,
+// ignoring blank lines and lines starting with #
+func readManifest(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
 
-	default:
-		return fmt.Errorf("unsupported file type: %s (must be .xml or .zip)", ext)
+	var names []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		names = append(names, line)
+	}
+
+	if len(names) == 0 {
+		return nil, fmt.Errorf("manifest %s lists no files", path)
 	}
+	return names, nil
 }
 
-func processZipFile(zipPath string, plates map[string]string) error {
-	r, err := zip.OpenReader(zipPath)
+// processManifest processes every file listed in the manifest, in order, into the
+// same plates map. Names that exist locally are read from disk, anything else is
+// downloaded from the registry directory on the FTP server. A failing file is
+// reported and skipped so the rest of the batch still gets processed.
+func processManifest(path string, plates map[string]Vehicle, cfg *Config) error {
+	names, err := readManifest(path)
 	if err != nil {
-		return fmt.Errorf("failed to open zip file: %w", err)
+		return err
 	}
-	defer r.Close()
-
-	processedCount := 0
 
-	for _, zipFile := range r.File {
-		if zipFile.FileInfo().IsDir() || !strings.HasSuffix(strings.ToLower(zipFile.Name), ".xml") {
-			continue
+	var session *ftpSession
+	var listing []*ftp.Entry
+	var remote map[string]*ftp.Entry
+	defer func() {
+		if session != nil {
+			session.Close()
 		}
+	}()
 
-		fmt.Printf("Processing: %s (%.2f MB)\n", zipFile.Name, float64(zipFile.UncompressedSize64)/(1024*1024))
+	var failed []string
+	for k, name := range names {
+		fmt.Printf("\n=== File %d of %d: %s ===\n", k+1, len(names), name)
 
-		rc, err := zipFile.Open()
-		if err != nil {
-			log.Printf("Warning: failed to open %s: %v", zipFile.Name, err)
+		if _, err := os.Stat(name); err == nil {
+			if err := processLocalFile(name, plates, cfg); err != nil {
+				log.Printf("Warning: failed to process %s: %v", name, err)
+				failed = append(failed, name)
+			}
 			continue
 		}
 
-		count, err := streamXML(rc, plates)
-		rc.Close()
+		if session == nil {
+			if session, err = newFTPSession(cfg); err != nil {
+				return err
+			}
+			if listing, err = session.list(); err != nil {
+				return err
+			}
+			remote = make(map[string]*ftp.Entry, len(listing))
+			for _, entry := range listing {
+				remote[entry.Name] = entry
+			}
+		}
 
-		if err != nil {
-			log.Printf("Warning: failed to process %s: %v", zipFile.Name, err)
+		entry, ok := remote[name]
+		if !ok || entry.Type != ftp.EntryTypeFile {
+			log.Printf("Warning: %s is neither a local file nor a file on the FTP server", name)
+			failed = append(failed, name)
 			continue
 		}
 
-		processedCount += count
+		if err := downloadAndProcessArchive(session, entry, listing, plates, cfg); err != nil {
+			log.Printf("Warning: failed to process %s: %v", name, err)
+			failed = append(failed, name)
+		}
 	}
 
-	fmt.Printf("\n✓ Successfully processed %d license plates\n", processedCount)
+	if len(failed) > 0 {
+		return fmt.Errorf("%d of %d files failed: %s", len(failed), len(names), strings.Join(failed, ", "))
+	}
 	return nil
 }
 
-func streamXML(reader io.Reader, plates map[string]string) (int, error) {
-	decoder := xml.NewDecoder(reader)
-	processedCount := 0
+// snapshotVersion must be bumped whenever Vehicle changes, so snapshots written by an
+// older build are rebuilt instead of being decoded into the wrong fields
+const snapshotVersion = 6
 
-	// Reuse buffer for string concatenation
-	var sb strings.Builder
-	sb.Grow(64) // Pre-allocate reasonable size for make+model
+// snapshotHeader is the first value in a snapshot file, followed by Count snapshotRecords
+type snapshotHeader struct {
+	Version      int
+	Key          string
+	PlatesOnly   bool
+	Mapping      map[string]string
+	PlateHash    string // hashPlate(salt, "") if plates are hashed, to detect a changed salt
+	Merge        string
+	Compact      []string // fields kept with -compact, nil if all fields are kept
+	IncludeEmpty bool
+	Sample       float64 // fraction of the records kept by -sample with Seed, 0 if all were
+	Seed         uint64
+	Newest       int       // archives processed together with -newest, 0 if only the newest one
+	Category     string    // EU vehicle category kept by -category, empty if all were
+	MaxEntries   int       // XML entries processed per archive with -max-entries, 0 if all were
+	Source       string    // file the plates were imported from
+	SourceTime   time.Time // modification time of Source, zero if unknown
+	Created      time.Time
+	Count        int
+}
 
-	for {
-		token, err := decoder.Token()
-		if err == io.EOF {
-			break
+type snapshotRecord struct {
+	Key     string
+	Vehicle Vehicle
+}
+
+// withSnapshot loads the plates from the -snapshot file if it was built from data at
+// least as new as sourceTime with the same options, and otherwise runs process and
+// saves the result as the new snapshot. A zero sourceTime never uses the snapshot.
+func withSnapshot(cfg *Config, source string, sourceTime time.Time, plates map[string]Vehicle, process func() error) error {
+	cfg.source, cfg.sourceTime = source, sourceTime
+	if cfg.stats != nil {
+		cfg.stats.Source = source
+		if !sourceTime.IsZero() {
+			cfg.stats.SourceTime = &sourceTime
 		}
+	}
+
+	if cfg.Snapshot == "" {
+		return process()
+	}
+
+	if !sourceTime.IsZero() {
+		loaded, err := loadSnapshot(cfg, sourceTime, plates)
 		if err != nil {
-			return processedCount, fmt.Errorf("XML parse error: %w", err)
+			log.Printf("Warning: ignoring snapshot %s: %v", cfg.Snapshot, err)
+			clear(plates)
 		}
+		if loaded {
+			return nil
+		}
+	}
 
-		if se, ok := token.(xml.StartElement); ok && se.Name.Local == "Statistik" {
-			var stat Statistik
-
-			if err := decoder.DecodeElement(&stat, &se); err != nil {
-				log.Printf("Warning: failed to decode Statistik: %v", err)
-				continue
-			}
+	if cfg.SinkNewOnly {
+		known, err := snapshotKeys(cfg)
+		if err != nil {
+			log.Printf("Warning: publishing all keys to -sink, failed to read snapshot %s: %v", cfg.Snapshot, err)
+		}
+		cfg.sinkKnown = known
+	}
 
-			if stat.RegistreringNummerNummer != "" {
-				// Build concatenated make and model
-				sb.Reset()
-				sb.WriteString(stat.KoeretoejOplysningGrundStruktur.KoeretoejBetegnelseStruktur.KoeretoejMaerkeTypeNavn)
-				sb.WriteString(" ")
-				sb.WriteString(stat.KoeretoejOplysningGrundStruktur.KoeretoejBetegnelseStruktur.Model.KoeretoejModelTypeNavn)
+	if err := process(); err != nil {
+		return err
+	}
+	cfg.sinkKnown = nil
 
-				plates[stat.RegistreringNummerNummer] = sb.String()
-				processedCount++
+	if cfg.Reconcile {
+		if err := reconcileSnapshot(cfg, plates); err != nil {
+			return fmt.Errorf("failed to reconcile with snapshot %s: %w", cfg.Snapshot, err)
+		}
+	}
 
-				if processedCount%10000 == 0 {
-					fmt.Printf("  Processed %d plates...\n", processedCount)
-				}
-			}
+	// Written after reconciling, so plates that went missing show up as changed to inactive
+	if cfg.Changes != "" {
+		if err := exportChanges(cfg, plates); err != nil {
+			return fmt.Errorf("failed to export changes: %w", err)
 		}
 	}
 
-	return processedCount, nil
+	return saveSnapshot(cfg, source, sourceTime, plates)
 }
 
-func downloadAndProcess(plates map[string]string) error {
-	conn, err := ftp.Dial("5.44.137.84:21", ftp.DialWithTimeout(10*time.Second))
+// openSnapshot opens the snapshot and decodes its header. The caller reads the
+// records from the decoder and closes the snapshot. A missing snapshot is returned
+// as an error matching os.ErrNotExist.
+func openSnapshot(path string) (io.Closer, *gob.Decoder, snapshotHeader, error) {
+	var header snapshotHeader
+	file, err := os.Open(path)
 	if err != nil {
-		return fmt.Errorf("failed to connect to FTP: %w", err)
+		return nil, nil, header, err
 	}
-	defer conn.Quit()
 
-	if err = conn.Login("anonymous", "anonymous"); err != nil {
-		return fmt.Errorf("failed to login: %w", err)
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, nil, header, err
 	}
 
-	if err = conn.ChangeDir("/ESStatistikListeModtag"); err != nil {
-		return fmt.Errorf("failed to change directory: %w", err)
+	decoder := gob.NewDecoder(bufio.NewReader(gz))
+	if err := decoder.Decode(&header); err != nil {
+		file.Close()
+		return nil, nil, header, err
+	}
+	return file, decoder, header, nil
+}
+
+// snapshotMatches reports whether a snapshot was built with the options that decide
+// which records are stored and how
+func (cfg *Config) snapshotMatches(header snapshotHeader) bool {
+	return header.Version == snapshotVersion && header.Key == cfg.Key && header.PlatesOnly == cfg.PlatesOnly &&
+		maps.Equal(header.Mapping, cfg.Mapping) && header.PlateHash == cfg.plateHashID() &&
+		header.Merge == cfg.Merge && slices.Equal(header.Compact, cfg.compactFieldNames()) &&
+		header.IncludeEmpty == cfg.IncludeEmpty && sampleMatches(header, cfg) &&
+		(header.Newest == cfg.Newest || (header.Newest == 0 && cfg.Newest == 1)) && header.Category == cfg.Category &&
+		header.MaxEntries == cfg.MaxEntries
+}
+
+// sampleMatches reports whether a snapshot holds the same -sample of the records as
+// the run would. Snapshots of all records have no seed.
+func sampleMatches(header snapshotHeader, cfg *Config) bool {
+	if cfg.Sample == 1 {
+		return header.Sample == 0
 	}
+	return header.Sample == cfg.Sample && header.Seed == cfg.Seed
+}
 
-	entries, err := conn.List(".")
+// reconcileSnapshot adds the plates of the previous snapshot that are missing from
+// the freshly imported plates, marking them as inactive since now. Plates already
+// inactive keep the time they first went missing, and plates that are back in the
+// feed are active again, as the new record replaces the old one. A snapshot built
+// with different options is not reconciled with, as its keys may not compare.
+func reconcileSnapshot(cfg *Config, plates map[string]Vehicle) error {
+	file, decoder, header, err := openSnapshot(cfg.Snapshot)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
 	if err != nil {
-		return fmt.Errorf("failed to list directory: %w", err)
+		return err
 	}
+	defer file.Close()
 
-	var newestZip *ftp.Entry
-	for _, entry := range entries {
-		if entry.Type == ftp.EntryTypeFile && strings.HasSuffix(entry.Name, ".zip") {
-			if newestZip == nil || entry.Time.After(newestZip.Time) {
-				newestZip = entry
-			}
+	if !cfg.snapshotMatches(header) {
+		log.Printf("Warning: snapshot %s was built with different options, not reconciling with it", cfg.Snapshot)
+		return nil
+	}
+
+	now := time.Now()
+	deactivated, inactive := 0, 0
+	for i := 0; i < header.Count; i++ {
+		var record snapshotRecord
+		if err := decoder.Decode(&record); err != nil {
+			return fmt.Errorf("failed to read record %d of %d: %w", i+1, header.Count, err)
+		}
+		if _, ok := plates[record.Key]; ok {
+			continue
+		}
+
+		if record.Vehicle.Inactive.IsZero() {
+			record.Vehicle.Inactive = now
+			deactivated++
 		}
+		plates[record.Key] = record.Vehicle
+		inactive++
 	}
 
-	if newestZip == nil {
-		return fmt.Errorf("no zip files found in directory")
+	fmt.Printf("\n✓ Marked %d plates missing from the feed as inactive, %d inactive in total (-reconcile)\n", deactivated, inactive)
+	return nil
+}
+
+// snapshotKeys returns the keys of the previous snapshot, or nil if there is none or
+// it was built with different options
+func snapshotKeys(cfg *Config) (map[string]bool, error) {
+	file, decoder, header, err := openSnapshot(cfg.Snapshot)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if !cfg.snapshotMatches(header) {
+		return nil, nil
 	}
 
-	fmt.Printf("Downloading: %s (%s)\n", newestZip.Name, newestZip.Time.Format(time.RFC3339))
-	fmt.Printf("File size: %.2f MB\n", float64(newestZip.Size)/(1024*1024))
+	keys := make(map[string]bool, header.Count)
+	for i := 0; i < header.Count; i++ {
+		var record snapshotRecord
+		if err := decoder.Decode(&record); err != nil {
+			return nil, fmt.Errorf("failed to read record %d of %d: %w", i+1, header.Count, err)
+		}
+		keys[record.Key] = true
+	}
+	return keys, nil
+}
 
-	resp, err := conn.Retr(newestZip.Name)
+// replaySnapshot reads every record of the snapshot at path into plates, whatever
+// source and options it was built with, and passes each one to cfg.onInsert,
+// so a -sink gets them as if they were parsed
+func replaySnapshot(cfg *Config, path string, plates map[string]Vehicle) error {
+	file, decoder, header, err := openSnapshot(path)
 	if err != nil {
-		return fmt.Errorf("failed to retrieve file: %w", err)
+		return fmt.Errorf("failed to read %s: %w", path, err)
 	}
-	defer resp.Close()
+	defer file.Close()
+
+	// Only the version matters, the records of an older one decode into the wrong fields
+	if header.Version != snapshotVersion {
+		return fmt.Errorf("%s has snapshot version %d, this build reads version %d", path, header.Version, snapshotVersion)
+	}
+
+	for i := 0; i < header.Count; i++ {
+		var record snapshotRecord
+		if err := decoder.Decode(&record); err != nil {
+			return fmt.Errorf("failed to read record %d of %d: %w", i+1, header.Count, err)
+		}
+		plates[record.Key] = record.Vehicle
+		if cfg.onInsert != nil {
+			cfg.onInsert(record.Key, record.Vehicle, true)
+		}
+	}
+
+	fmt.Printf("\n✓ Replayed %d license plates keyed on %s from snapshot %s (built from %s on %s)\n",
+		len(plates), header.Key, path, header.Source, header.Created.Format(time.RFC3339))
+	return nil
+}
+
+// fieldChange is a field of a plate that has a different value than in the previous
+// snapshot. Values are formatted as in the CSV export.
+type fieldChange struct {
+	Field string `json:"field"`
+	Old   string `json:"old"`
+	New   string `json:"new"`
+}
+
+// changeEvent lists the changed fields of one plate, in -fields order
+type changeEvent struct {
+	Key     string        `json:"key"`
+	Changes []fieldChange `json:"changes"`
+}
 
-	tempFile, err := os.CreateTemp("", "ftp-zip-*.zip")
+// exportChanges compares the plates to the previous snapshot and writes a change
+// event for each plate in both whose -fields differ. Plates that are new or missing
+// from the feed are not compared. A snapshot built with different options is not
+// compared with, as its keys and fields may not match.
+func exportChanges(cfg *Config, plates map[string]Vehicle) error {
+	file, decoder, header, err := openSnapshot(cfg.Snapshot)
+	if errors.Is(err, os.ErrNotExist) {
+		log.Printf("No previous snapshot %s to compare with, not writing %s", cfg.Snapshot, cfg.Changes)
+		return nil
+	}
 	if err != nil {
-		return fmt.Errorf("failed to create temp file: %w", err)
+		return err
 	}
-	defer os.Remove(tempFile.Name())
-	defer tempFile.Close()
+	defer file.Close()
 
-	progressReader := &ProgressReader{
-		reader: resp,
-		total:  int64(newestZip.Size),
+	if !cfg.snapshotMatches(header) {
+		log.Printf("Warning: snapshot %s was built with different options, not writing %s", cfg.Snapshot, cfg.Changes)
+		return nil
 	}
 
-	written, err := io.Copy(tempFile, progressReader)
+	out, err := os.Create(cfg.Changes)
 	if err != nil {
-		return fmt.Errorf("failed to stream file: %w", err)
+		return fmt.Errorf("failed to create changes file: %w", err)
 	}
+	defer out.Close()
 
-	fmt.Printf("\n✓ Downloaded %d bytes\n", written)
-	tempFile.Close()
+	w := bufio.NewWriter(out)
+	encoder := json.NewEncoder(w)
+	changed := 0
+	for i := 0; i < header.Count; i++ {
+		var record snapshotRecord
+		if err := decoder.Decode(&record); err != nil {
+			return fmt.Errorf("failed to read record %d of %d: %w", i+1, header.Count, err)
+		}
+		vehicle, ok := plates[record.Key]
+		if !ok {
+			continue
+		}
+
+		old, current := plateEntry{record.Key, record.Vehicle}, plateEntry{record.Key, vehicle}
+		var changes []fieldChange
+		for _, f := range cfg.Fields {
+			if before, after := f.Value(old), f.Value(current); before != after {
+				changes = append(changes, fieldChange{f.Name, before, after})
+			}
+		}
+		if len(changes) == 0 {
+			continue
+		}
+		if err := encoder.Encode(changeEvent{record.Key, changes}); err != nil {
+			return fmt.Errorf("failed to write changes: %w", err)
+		}
+		changed++
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("failed to write changes: %w", err)
+	}
 
-	return processZipFile(tempFile.Name(), plates)
+	fmt.Printf("\n✓ Exported changes of %d plates since the snapshot of %s to %s\n", changed, header.Created.Format(time.RFC3339), cfg.Changes)
+	return out.Close()
 }
 
-func displayResults(plates map[string]string) {
-	// Convert map to sorted slice for display
-	type plateEntry struct {
-		plate         string
-		makeModelName string
+// loadSnapshot reads the snapshot into plates, returning false without reading any
+// records when it is missing, stale or was built with a different key or mode
+func loadSnapshot(cfg *Config, sourceTime time.Time, plates map[string]Vehicle) (bool, error) {
+	file, decoder, header, err := openSnapshot(cfg.Snapshot)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
 	}
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
 
-	entries := make([]plateEntry, 0, len(plates))
-	for plate, makeModel := range plates {
-		entries = append(entries, plateEntry{plate, makeModel})
+	switch {
+	case !cfg.snapshotMatches(header):
+		log.Printf("Snapshot %s was built with different options, rebuilding it", cfg.Snapshot)
+		return false, nil
+	case header.SourceTime.IsZero() || sourceTime.After(header.SourceTime):
+		log.Printf("Snapshot %s is older than the source data, rebuilding it", cfg.Snapshot)
+		return false, nil
 	}
 
-	sort.Slice(entries, func(i, j int) bool {
-		return entries[i].plate < entries[j].plate
-	})
+	for i := 0; i < header.Count; i++ {
+		var record snapshotRecord
+		if err := decoder.Decode(&record); err != nil {
+			return false, fmt.Errorf("failed to read record %d of %d: %w", i+1, header.Count, err)
+		}
+		plates[record.Key] = record.Vehicle
+	}
 
-	fmt.Printf("\n=== License Plates in Database (%d total) ===\n", len(entries))
-	displayLimit := 10
-	if len(entries) < displayLimit {
-		displayLimit = len(entries)
+	fmt.Printf("\n✓ Loaded %d license plates from snapshot %s (built from %s)\n", len(plates), cfg.Snapshot, header.Source)
+	return true, nil
+}
+
+// plateHashID identifies the salt plates are hashed with, without revealing it.
+// It is empty if plates are not hashed.
+func (cfg *Config) plateHashID() string {
+	if !cfg.HashPlates {
+		return ""
+	}
+	return hashPlate(cfg.HashSalt, "")
+}
+
+// compactFieldNames lists the fields kept with -compact in a stable order, nil if
+// all fields are kept
+func (cfg *Config) compactFieldNames() []string {
+	if !cfg.Compact {
+		return nil
 	}
+	return slices.Sorted(maps.Keys(cfg.compactFields))
+}
 
-	for i := 0; i < displayLimit; i++ {
-		fmt.Printf("%d. %s - %s\n", i+1, entries[i].plate, entries[i].makeModelName)
+// saveSnapshot writes plates to the snapshot file, replacing it only once the new
+// snapshot has been written completely
+func saveSnapshot(cfg *Config, source string, sourceTime time.Time, plates map[string]Vehicle) error {
+	tempFile, err := os.CreateTemp(filepath.Dir(cfg.Snapshot), ".snapshot-*")
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot: %w", err)
 	}
+	defer os.Remove(tempFile.Name())
+	defer tempFile.Close()
 
-	if len(entries) > displayLimit {
-		fmt.Printf("... and %d more\n", len(entries)-displayLimit)
+	buffered := bufio.NewWriter(tempFile)
+	gz := gzip.NewWriter(buffered)
+	encoder := gob.NewEncoder(gz)
+
+	header := snapshotHeader{
+		Version:      snapshotVersion,
+		Key:          cfg.Key,
+		PlatesOnly:   cfg.PlatesOnly,
+		Mapping:      cfg.Mapping,
+		PlateHash:    cfg.plateHashID(),
+		Merge:        cfg.Merge,
+		Compact:      cfg.compactFieldNames(),
+		IncludeEmpty: cfg.IncludeEmpty,
+		Category:     cfg.Category,
+		MaxEntries:   cfg.MaxEntries,
+		Source:       source,
+		SourceTime:   sourceTime,
+		Created:      time.Now(),
+		Count:        len(plates),
 	}
+	if cfg.Sample < 1 {
+		header.Sample, header.Seed = cfg.Sample, cfg.Seed
+	}
+	if cfg.Newest > 1 {
+		header.Newest = cfg.Newest
+	}
+	if err := encoder.Encode(header); err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+
+	// One record per value keeps the encoder from buffering the whole map in memory
+	for key, vehicle := range plates {
+		if err := encoder.Encode(snapshotRecord{key, vehicle}); err != nil {
+			return fmt.Errorf("failed to write snapshot: %w", err)
+		}
+	}
+
+	if err := gz.Close(); err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	if err := buffered.Flush(); err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	if err := tempFile.Close(); err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+
+	// CreateTemp makes the file private, snapshots get the same permissions as exports
+	if err := os.Chmod(tempFile.Name(), 0o644); err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+
+	if err := os.Rename(tempFile.Name(), cfg.Snapshot); err != nil {
+		return fmt.Errorf("failed to replace snapshot: %w", err)
+	}
+
+	fmt.Printf("✓ Saved snapshot of %d plates to %s\n", len(plates), cfg.Snapshot)
+	return nil
 }
@@ -0,0 +1,856 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// generatedPlates returns n vehicles keyed on their plate. The plates fail
+// validatePlate as a regular number below 10000, and all vehicles share one long
+// VIN, so the exports are much larger than the map.
+func generatedPlates(n int) map[string]Vehicle {
+	vin := strings.Repeat("W", 1000)
+	plates := make(map[string]Vehicle, n)
+	for i := 0; i < n; i++ {
+		plate := fmt.Sprintf("%c%c0%04d", 'A'+i/260000%26, 'A'+i/10000%26, i%10000)
+		plates[plate] = Vehicle{Plate: plate, VIN: vin, Make: "AUDI", Model: "A 6"}
+	}
+	return plates
+}
+
+// peakHeapGrowth runs f and returns how far the heap grew above its size before f,
+// sampled every millisecond while f runs. The GC runs more often meanwhile, so
+// garbage does not count as growth for long.
+func peakHeapGrowth(f func()) uint64 {
+	defer debug.SetGCPercent(debug.SetGCPercent(10))
+	runtime.GC()
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	base := m.HeapAlloc
+
+	done := make(chan struct{})
+	sampled := make(chan uint64)
+	go func() {
+		ticker := time.NewTicker(time.Millisecond)
+		defer ticker.Stop()
+		var peak uint64
+		for {
+			select {
+			case <-done:
+				sampled <- peak
+				return
+			case <-ticker.C:
+				var m runtime.MemStats
+				runtime.ReadMemStats(&m)
+				peak = max(peak, m.HeapAlloc)
+			}
+		}
+	}()
+	f()
+	runtime.ReadMemStats(&m)
+	close(done)
+
+	peak := max(<-sampled, m.HeapAlloc)
+	if peak < base {
+		return 0
+	}
+	return peak - base
+}
+
+// countLines returns the number of lines in the file at path
+func countLines(t *testing.T, path string) int {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1<<20)
+	lines := 0
+	for scanner.Scan() {
+		lines++
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return lines
+}
+
+// parquetRows returns the number of rows in the Parquet file at path
+func parquetRows(t *testing.T, path string) int {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := parquet.OpenFile(file, info.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return int(f.NumRows())
+}
+
+func TestExportsDoNotBufferTheFile(t *testing.T) {
+	const n, flushRows = 50000, 1000
+	plates := generatedPlates(n)
+	dir := t.TempDir()
+
+	// The text exports have a header line
+	lines := func(t *testing.T, path string) int {
+		return countLines(t, path) - 1
+	}
+	exports := []struct {
+		name   string
+		export func(path string) error
+		rows   func(t *testing.T, path string) int
+		// rowGroup is set for the exports that hold a group of flushRows rows before
+		// writing them
+		rowGroup bool
+	}{
+		{"plates csv", func(path string) error {
+			return exportCSV(path, plates, &Config{Fields: vehicleFields, Sort: "plate", ExportFlush: flushRows, csvComma: ','})
+		}, lines, false},
+		{"plates parquet", func(path string) error {
+			return exportParquet(path, plates, "plate", time.Time{}, flushRows)
+		}, parquetRows, true},
+		{"plate to VIN map", func(path string) error {
+			return exportPlateVINMap(path, plates, "plate", time.Time{}, flushRows)
+		}, lines, false},
+		{"invalid plates", func(path string) error {
+			return exportInvalidPlates(path, plates, "plate", time.Time{}, flushRows)
+		}, lines, false},
+	}
+	for _, e := range exports {
+		path := filepath.Join(dir, strings.ReplaceAll(e.name, " ", "-"))
+		var err error
+		growth := peakHeapGrowth(func() { err = e.export(path) })
+		if err != nil {
+			t.Fatalf("%s: %v", e.name, err)
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The sorted keys are held, 16 bytes each, but never the rows. The Parquet
+		// writer holds a row group of flushRows rows until it is written, and copies
+		// it once while encoding it.
+		limit := uint64(info.Size() / 10)
+		if e.rowGroup {
+			limit += 2 * uint64(info.Size()) * flushRows / n
+		}
+		if growth > limit {
+			t.Errorf("%s: the heap grew by %d bytes while writing %d bytes, want at most %d", e.name, growth, info.Size(), limit)
+		}
+		if rows := e.rows(t, path); rows != n {
+			t.Errorf("%s: wrote %d rows, want %d", e.name, rows, n)
+		}
+	}
+}
+
+// TestExportsWriteEveryPlate exports more plates than the summary shows, and
+// flushes in between, and checks that no row is left out
+func TestExportsWriteEveryPlate(t *testing.T) {
+	const n = 25
+	plates := generatedPlates(n)
+	dir := t.TempDir()
+
+	csvPath := filepath.Join(dir, "plates.csv")
+	cfg := &Config{Fields: vehicleFields, Sort: "plate", ExportFlush: 7, csvComma: ','}
+	if err := exportCSV(csvPath, plates, cfg); err != nil {
+		t.Fatal(err)
+	}
+	txtPath := filepath.Join(dir, "plates.txt")
+	if err := exportPlatesTxt(txtPath, plates, "plate", "plate", time.Time{}, 7); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, export := range []struct {
+		path   string
+		header bool
+	}{{csvPath, true}, {txtPath, false}} {
+		data, err := os.ReadFile(export.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+		if export.header {
+			lines = lines[1:]
+		}
+		seen := make(map[string]bool)
+		for _, line := range lines {
+			plate, _, _ := strings.Cut(line, ",")
+			if _, ok := plates[plate]; !ok || seen[plate] {
+				t.Errorf("%s: unexpected row %.40q", export.path, line)
+			}
+			seen[plate] = true
+		}
+		if len(seen) != n {
+			t.Errorf("%s: wrote %d of the %d plates", export.path, len(seen), n)
+		}
+	}
+}
+
+// TestQueriesMatchThePlate queries vehicles keyed on their VIN, which must still be
+// found by their plate
+func TestQueriesMatchThePlate(t *testing.T) {
+	plates := map[string]Vehicle{
+		"WAUZZZ4F38N000001": {Plate: "AB12345"},
+		"WAUZZZ4F38N000002": {Plate: "AB12346"},
+		"WAUZZZ4F38N000003": {Plate: "XY99999"},
+		"WAUZZZ4F38N000004": {},
+	}
+	ranged, err := queryRange(plates, "AB00000", "AB99999")
+	if err != nil {
+		t.Fatal(err)
+	}
+	regex, err := queryRegex(plates, "^AB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range []struct {
+		name    string
+		results []plateEntry
+	}{
+		{"range", ranged},
+		{"fuzzy", queryFuzzy(plates, "AB12340", 1)},
+		{"regex", regex},
+		{"prefix", queryPrefix(plates, "AB")},
+	} {
+		var keys []string
+		for _, entry := range q.results {
+			keys = append(keys, entry.key)
+		}
+		if got, want := strings.Join(keys, " "), "WAUZZZ4F38N000001 WAUZZZ4F38N000002"; got != want {
+			t.Errorf("%s: found %q, want %q", q.name, got, want)
+		}
+	}
+
+	if got, want := listedBy(&Config{Key: "vin"}, "Plates matching %s", "^AB"), "Plates matching ^AB, listed by vin"; got != want {
+		t.Errorf("listedBy: got %q, want %q", got, want)
+	}
+	if got, want := listedBy(&Config{Key: "plate"}, "Plates matching %s", "^AB"), "Plates matching ^AB"; got != want {
+		t.Errorf("listedBy: got %q, want %q", got, want)
+	}
+}
+
+// TestDuplicateEntriesAreProcessedOnce processes an archive with three entries of
+// the same name: two copies of the same records and an empty one
+func TestDuplicateEntriesAreProcessedOnce(t *testing.T) {
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	plates := make(map[string]Vehicle)
+	cfg := &Config{Key: "plate", plateCounts: make(map[string]int)}
+	if err := processArchiveFile("test/duplicate-entries.zip", plates, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(plates) != 1 {
+		t.Errorf("got %d plates, want 1", len(plates))
+	}
+	if got := cfg.plateCounts["WW35733"]; got != 1 {
+		t.Errorf("WW35733 was read %d times, want once", got)
+	}
+	if got := strings.Count(logged.String(), "skipping duplicate entry ESStatistikListeModtag-20261102-165603.xml"); got != 2 {
+		t.Errorf("warned about %d duplicate entries, want 2:\n%s", got, logged.String())
+	}
+}
+
+// TestStreamXMLUnescapesText reads a feed with entities and CDATA sections in the
+// plate, make and model with each of the ways streamXML extracts records
+func TestStreamXMLUnescapesText(t *testing.T) {
+	mapping, err := loadMapping("test/mapping.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]Vehicle{
+		"AB12345": {Plate: "AB12345", Make: "ROLLS & ROYCE", Model: "GRæSSLAGER"},
+		"CD67890": {Plate: "CD67890", Make: "A&B <MOTORS>", Model: "Søren & S&N"},
+	}
+	for _, c := range []struct {
+		name string
+		cfg  *Config
+	}{
+		{"decode", &Config{Key: "plate"}},
+		// Extracts only the plate
+		{"plates only", &Config{Key: "plate", PlatesOnly: true}},
+		// Extracts the make and model from the raw tokens too
+		{"mapping", &Config{Key: "plate", Mapping: mapping}},
+	} {
+		file, err := os.Open("test/entities.xml")
+		if err != nil {
+			t.Fatal(err)
+		}
+		plates := make(map[string]Vehicle)
+		_, err = streamXML("entities.xml", file, plates, c.cfg)
+		file.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+
+		if len(plates) != len(want) {
+			t.Errorf("%s: got %d plates, want %d", c.name, len(plates), len(want))
+		}
+		for plate, w := range want {
+			if c.cfg.PlatesOnly {
+				w.Make, w.Model = "", ""
+			}
+			v, ok := plates[plate]
+			if !ok {
+				t.Errorf("%s: plate %q is missing", c.name, plate)
+				continue
+			}
+			if v.Plate != w.Plate || v.Make != w.Make || v.Model != w.Model {
+				t.Errorf("%s: got %q %q %q, want %q %q %q", c.name, v.Plate, v.Make, v.Model, w.Plate, w.Make, w.Model)
+			}
+		}
+	}
+}
+
+// TestJoinSplitZip joins test/split-archive.z01 and .zip, whose only entry is stored
+// across both parts, with the right part boundaries and wrong ones
+func TestJoinSplitZip(t *testing.T) {
+	var parts [][]byte
+	for _, path := range []string{"test/split-archive.z01", "test/split-archive.zip"} {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts = append(parts, data)
+	}
+	first := int64(len(parts[0]))
+
+	for _, c := range []struct {
+		name   string
+		parts  [][]byte
+		starts []int64
+		ok     bool
+	}{
+		{"joined", parts, []int64{0, first}, true},
+		{"boundary too early", parts, []int64{0, first - 100}, false},
+		{"boundary too late", parts, []int64{0, first + 100}, false},
+		{"missing part", parts[1:], []int64{0}, false},
+	} {
+		file, err := os.CreateTemp(t.TempDir(), "split-*.zip")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, part := range c.parts {
+			if _, err := file.Write(part); err != nil {
+				t.Fatal(err)
+			}
+		}
+		err = joinSplitZip(file, c.starts)
+		file.Close()
+		if !c.ok {
+			if err == nil {
+				t.Errorf("%s: joined without an error", c.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+
+		r, err := zip.OpenReader(file.Name())
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if len(r.File) != 1 {
+			t.Fatalf("%s: got %d entries, want 1", c.name, len(r.File))
+		}
+		rc, err := r.File[0].Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Reading to the end checks the CRC
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		r.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if n := bytes.Count(data, []byte("<ns:Statistik>")); n != 5 {
+			t.Errorf("%s: the entry has %d records, want 5", c.name, n)
+		}
+	}
+}
+
+// TestREPLGetHashedPlates looks up hashed plates the way they were hashed from the
+// feed, as they are and in upper case
+func TestREPLGetHashedPlates(t *testing.T) {
+	cfg := &Config{Key: "plate", HashPlates: true, HashSalt: "salt"}
+	plates := make(map[string]Vehicle)
+	for _, plate := range []string{"AB12345", "cd67890"} {
+		hashed := hashPlate(cfg.HashSalt, plate)
+		plates[hashed] = Vehicle{Plate: hashed, Make: "AUDI"}
+	}
+
+	for _, c := range []struct {
+		typed string
+		ok    bool
+	}{
+		{"AB12345", true},
+		{"ab12345", true},
+		{"cd67890", true},
+		{"CD67890", false},
+		{"", false},
+	} {
+		err := runREPLCommand("get", []string{c.typed}, plates, cfg)
+		if c.ok && err != nil {
+			t.Errorf("get %q: %v", c.typed, err)
+		} else if !c.ok && err == nil {
+			t.Errorf("get %q: found a vehicle, want none", c.typed)
+		}
+	}
+}
+
+func TestValidatePlate(t *testing.T) {
+	for _, c := range []struct {
+		plate   string
+		problem string
+	}{
+		{"AB12345", ""},
+		{"ab 12 345", ""},
+		{"AB", ""},
+		{"HELLO", ""},
+		{"ABCDEFG", ""},
+		{"ÆØÅ", ""},
+		{"", invalidFormat},
+		{"A", invalidFormat},
+		{"ABCDEFGH", invalidFormat},
+		{"AB-1234", invalidFormat},
+		{"1234567", implausible},
+		{"ÆB12345", implausible},
+		{"AB01234", implausible},
+	} {
+		if problem, reason := validatePlate(c.plate); problem != c.problem {
+			t.Errorf("validatePlate(%q) = %q (%s), want %q", c.plate, problem, reason, c.problem)
+		}
+	}
+}
+
+func TestNaturalLess(t *testing.T) {
+	for _, c := range []struct {
+		a, b string
+		less bool
+	}{
+		{"AB2", "AB10", true},
+		{"AB10", "AB2", false},
+		{"AB99999", "AC10000", true},
+		{"AB01", "AB1", true},
+		{"AB1", "AB01", false},
+		{"AB1", "AB1", false},
+		{"AB1X", "AB1Y", true},
+		{"", "A", true},
+		{"A", "", false},
+		{"HELLO", "AB12345", false},
+		{"A123456789012345678901234567890", "A123456789012345678901234567891", true},
+	} {
+		if less := naturalLess(c.a, c.b); less != c.less {
+			t.Errorf("naturalLess(%q, %q) = %v, want %v", c.a, c.b, less, c.less)
+		}
+	}
+}
+
+func TestLevenshtein(t *testing.T) {
+	for _, c := range []struct {
+		a, b string
+		dist int
+	}{
+		{"", "", 0},
+		{"", "ABC", 3},
+		{"ABC", "", 3},
+		{"AB12345", "AB12345", 0},
+		{"AB12345", "AB12346", 1},
+		{"AB12345", "AB1234", 1},
+		{"AB12345", "BA12345", 2},
+		{"KITTEN", "SITTING", 3},
+		{"ÆB12345", "AB12345", 1},
+	} {
+		if dist := levenshtein(c.a, c.b); dist != c.dist {
+			t.Errorf("levenshtein(%q, %q) = %d, want %d", c.a, c.b, dist, c.dist)
+		}
+	}
+}
+
+// entryKeys returns the keys of query results, separated by spaces
+func entryKeys(results []plateEntry) string {
+	keys := make([]string, len(results))
+	for i, entry := range results {
+		keys[i] = entry.key
+	}
+	return strings.Join(keys, " ")
+}
+
+func TestQueryFuzzy(t *testing.T) {
+	plates := make(map[string]Vehicle)
+	for _, plate := range []string{"AB12345", "AB12346", "AC12346", "AB1234", "XY99999"} {
+		plates[plate] = Vehicle{Plate: plate}
+	}
+	for _, c := range []struct {
+		plate string
+		dist  int
+		want  string
+	}{
+		{"AB12345", 0, "AB12345"},
+		{"AB12345", 1, "AB12345 AB1234 AB12346"},
+		{"AB12345", 2, "AB12345 AB1234 AB12346 AC12346"},
+		{"ab12345", 0, ""},
+		{"", 6, "AB1234"},
+		{"", 7, "AB1234 AB12345 AB12346 AC12346 XY99999"},
+	} {
+		if got := entryKeys(queryFuzzy(plates, c.plate, c.dist)); got != c.want {
+			t.Errorf("queryFuzzy(%q, %d) = %q, want %q", c.plate, c.dist, got, c.want)
+		}
+	}
+	if got := queryFuzzy(map[string]Vehicle{}, "AB12345", 7); len(got) != 0 {
+		t.Errorf("queryFuzzy of no plates found %d", len(got))
+	}
+
+	many := generatedPlates(maxFuzzyResults + 50)
+	if got := queryFuzzy(many, "AA00000", 7); len(got) != maxFuzzyResults {
+		t.Errorf("queryFuzzy found %d plates, want at most %d", len(got), maxFuzzyResults)
+	}
+}
+
+func TestQueryRange(t *testing.T) {
+	plates := make(map[string]Vehicle)
+	for _, plate := range []string{"AB12345", "AB12346", "AC00000", "XY99999"} {
+		plates[plate] = Vehicle{Plate: plate}
+	}
+	for _, c := range []struct {
+		lo, hi string
+		want   string
+		err    bool
+	}{
+		{"AB12345", "AB12346", "AB12345 AB12346", false},
+		{"AB12345", "AB12345", "AB12345", false},
+		{"AB12346", "AB12345", "", true},
+		{"AA", "AB", "", false},
+		{"", "", "", false},
+		{"A", "Z", "AB12345 AB12346 AC00000 XY99999", false},
+		{"", "AC00000", "AB12345 AB12346 AC00000", false},
+	} {
+		results, err := queryRange(plates, c.lo, c.hi)
+		if (err != nil) != c.err {
+			t.Errorf("queryRange(%q, %q) returned error %v, want an error: %v", c.lo, c.hi, err, c.err)
+			continue
+		}
+		if got := entryKeys(results); got != c.want {
+			t.Errorf("queryRange(%q, %q) = %q, want %q", c.lo, c.hi, got, c.want)
+		}
+	}
+}
+
+func TestParseByteSize(t *testing.T) {
+	for _, c := range []struct {
+		value string
+		size  ByteSize
+		err   bool
+	}{
+		{"0", 0, false},
+		{"1", 1, false},
+		{"512B", 512, false},
+		{"1KB", 1 << 10, false},
+		{"1.5kb", 1536, false},
+		{" 4 GB ", 4 << 30, false},
+		{"2TB", 2 << 40, false},
+		{"8388607TB", 8388607 << 40, false},
+		{"8388608TB", 0, true},
+		{"", 0, true},
+		{"KB", 0, true},
+		{"-1MB", 0, true},
+		{"10XB", 0, true},
+		{"10PB", 0, true},
+		{"NaN", 0, true},
+		{"Inf", 0, true},
+	} {
+		size, err := parseByteSize(c.value)
+		if (err != nil) != c.err || size != c.size {
+			t.Errorf("parseByteSize(%q) = %d, %v, want %d (error: %v)", c.value, size, err, c.size, c.err)
+		}
+	}
+}
+
+func TestParseMakeExpectation(t *testing.T) {
+	for _, c := range []struct {
+		value string
+		want  makeExpectation
+		err   bool
+	}{
+		{"Toyota:>10000", makeExpectation{"Toyota", ">", 10000}, false},
+		{"Toyota:>=0", makeExpectation{"Toyota", ">=", 0}, false},
+		{" ALFA ROMEO : <= 5 ", makeExpectation{"ALFA ROMEO", "<=", 5}, false},
+		{"A:B:=3", makeExpectation{"A:B", "=", 3}, false},
+		{"Toyota:<1", makeExpectation{"Toyota", "<", 1}, false},
+		{"", makeExpectation{}, true},
+		{"Toyota", makeExpectation{}, true},
+		{":>1", makeExpectation{}, true},
+		{"Toyota:10", makeExpectation{}, true},
+		{"Toyota:>", makeExpectation{}, true},
+		{"Toyota:>-1", makeExpectation{}, true},
+		{"Toyota:>ten", makeExpectation{}, true},
+	} {
+		e, err := parseMakeExpectation(c.value)
+		if (err != nil) != c.err || e != c.want {
+			t.Errorf("parseMakeExpectation(%q) = %v, %v, want %v (error: %v)", c.value, e, err, c.want, c.err)
+		}
+	}
+}
+
+func TestSuppressBuckets(t *testing.T) {
+	for _, c := range []struct {
+		counts map[string]int
+		k      int
+		want   string
+	}{
+		{map[string]int{}, 5, ""},
+		{map[string]int{"a": 5, "b": 3, "c": 1}, 0, "a:5 b:3 c:1"},
+		{map[string]int{"a": 5, "b": 3, "c": 1}, 1, "a:5 b:3 c:1"},
+		{map[string]int{"a": 5, "b": 3, "c": 3, "d": 1}, 3, "a:5 b:3 " + otherBucket + ":4"},
+		// The other bucket is still below k, so the smallest remaining one joins it
+		{map[string]int{"a": 5, "b": 3, "c": 1, "d": 1}, 3, "a:5 " + otherBucket + ":5"},
+		{map[string]int{"a": 1, "b": 1}, 5, otherBucket + ":2"},
+		{map[string]int{"a": 5, "b": 5}, 5, "a:5 b:5"},
+	} {
+		var got []string
+		for _, b := range suppressBuckets(c.counts, c.k) {
+			got = append(got, fmt.Sprintf("%s:%d", b.Value, b.Count))
+		}
+		if strings.Join(got, " ") != c.want {
+			t.Errorf("suppressBuckets(%v, %d) = %q, want %q", c.counts, c.k, strings.Join(got, " "), c.want)
+		}
+	}
+}
+
+func TestVehicleCategory(t *testing.T) {
+	for _, c := range []struct {
+		vehicleType string
+		maxMass     int
+		want        string
+	}{
+		{"Personbil", 0, "M1"},
+		{" PERSONBIL ", 2000, "M1"},
+		{"Bus", 5000, "M2"},
+		{"Bus", 5001, "M3"},
+		{"Bus", 0, unclassified},
+		{"Påhængsvogn", 750, "O1"},
+		{"Påhængsvogn", 751, "O2"},
+		{"Påhængsvogn", 10000, "O3"},
+		{"Påhængsvogn", 10001, "O4"},
+		{"Påhængsvogn", -1, unclassified},
+		{"Motorredskab", 1000, unclassified},
+		{"", 0, unclassified},
+		{"Rumskib", 1000, ""},
+	} {
+		if got := vehicleCategory(c.vehicleType, c.maxMass); got != c.want {
+			t.Errorf("vehicleCategory(%q, %d) = %q, want %q", c.vehicleType, c.maxMass, got, c.want)
+		}
+	}
+}
+
+func TestParseFlexibleDate(t *testing.T) {
+	cet := time.FixedZone("", 3600)
+	for _, c := range []struct {
+		value string
+		want  time.Time
+		err   bool
+	}{
+		{"2007-11-28+01:00", time.Date(2007, 11, 28, 0, 0, 0, 0, cet), false},
+		{"2007-11-28Z", time.Date(2007, 11, 28, 0, 0, 0, 0, time.UTC), false},
+		{"2020-12-23T09:21:18.000+01:00", time.Date(2020, 12, 23, 9, 21, 18, 0, cet), false},
+		{"2007-11-28", time.Date(2007, 11, 28, 0, 0, 0, 0, time.UTC), false},
+		{"28-11-2007", time.Date(2007, 11, 28, 0, 0, 0, 0, time.UTC), false},
+		{"", time.Time{}, true},
+		{"2007-13-01", time.Time{}, true},
+		{"2007-02-30", time.Time{}, true},
+		{"28.11.2007", time.Time{}, true},
+		{"20071128", time.Time{}, true},
+	} {
+		got, err := parseFlexibleDate(c.value)
+		if (err != nil) != c.err || !got.Equal(c.want) {
+			t.Errorf("parseFlexibleDate(%q) = %v, %v, want %v (error: %v)", c.value, got, err, c.want, c.err)
+		}
+	}
+}
+
+func TestMergeVehicles(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2026, 1, d, 0, 0, 0, 0, time.UTC) }
+	for _, c := range []struct {
+		name            string
+		policy          string
+		existing, later Vehicle
+		want            Vehicle
+	}{
+		{"last", "last", Vehicle{Make: "AUDI", StatusTime: day(2)}, Vehicle{Model: "A 6", StatusTime: day(1)},
+			Vehicle{Model: "A 6", StatusTime: day(1)}},
+		{"newest keeps the newer status", "newest", Vehicle{Make: "AUDI", StatusTime: day(2)}, Vehicle{Make: "BMW", StatusTime: day(1)},
+			Vehicle{Make: "AUDI", StatusTime: day(2)}},
+		{"newest takes the later record on a tie", "newest", Vehicle{Make: "AUDI", StatusTime: day(1)}, Vehicle{Make: "BMW", StatusTime: day(1)},
+			Vehicle{Make: "BMW", StatusTime: day(1)}},
+		{"newest falls back to the first registration", "newest",
+			Vehicle{Make: "AUDI", FirstRegistration: day(3)}, Vehicle{Make: "BMW", FirstRegistration: day(2)},
+			Vehicle{Make: "AUDI", FirstRegistration: day(3)}},
+		{"newest without dates", "newest", Vehicle{Make: "AUDI"}, Vehicle{Make: "BMW"}, Vehicle{Make: "BMW"}},
+		{"fill", "fill",
+			Vehicle{Plate: "AB12345", Make: "AUDI", Model: "A 4", CO2: 120, LastInspection: day(1)},
+			Vehicle{Plate: "AB12345", Model: "A 6", KerbWeight: 1500},
+			Vehicle{Plate: "AB12345", Make: "AUDI", Model: "A 6", KerbWeight: 1500, CO2: 120, LastInspection: day(1)}},
+		{"fill empty records", "fill", Vehicle{}, Vehicle{}, Vehicle{}},
+	} {
+		if got := mergeVehicles(c.policy, c.existing, c.later); got != c.want {
+			t.Errorf("%s: got %+v, want %+v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestSplitPartNames(t *testing.T) {
+	for _, c := range []struct {
+		zipName string
+		names   []string
+		want    string
+		err     bool
+	}{
+		{"a.zip", []string{"a.zip"}, "", false},
+		{"a.zip", nil, "", false},
+		{"a.zip", []string{"a.z02", "a.zip", "a.z01"}, "a.z01 a.z02", false},
+		{"A.ZIP", []string{"A.Z01", "a.z02", "A.ZIP"}, "A.Z01 a.z02", false},
+		{"a.zip", []string{"a.z01", "a.z03", "a.zip"}, "", true},
+		{"a.zip", []string{"a.z02", "a.zip"}, "", true},
+		{"a.zip", []string{"a.z09", "a.z10", "a.z01", "a.z02", "a.z03", "a.z04", "a.z05", "a.z06", "a.z07", "a.z08"},
+			"a.z01 a.z02 a.z03 a.z04 a.z05 a.z06 a.z07 a.z08 a.z09 a.z10", false},
+		// Not parts of a.zip
+		{"a.zip", []string{"a.z00", "a.z1x", "a.zz01", "ab.z01", "a.z"}, "", false},
+		{"a.7z", []string{"a.z01"}, "", false},
+		{"", []string{".z01"}, "", false},
+	} {
+		parts, err := splitPartNames(c.zipName, c.names)
+		if (err != nil) != c.err || strings.Join(parts, " ") != c.want {
+			t.Errorf("splitPartNames(%q, %q) = %q, %v, want %q (error: %v)", c.zipName, c.names, parts, err, c.want, c.err)
+		}
+	}
+}
+
+func TestScanMapped(t *testing.T) {
+	mapping := map[string]string{
+		"RegistreringNummerNummer":    "plate",
+		"Grund/Betegnelse/Maerke":     "make",
+		"Grund/Betegnelse/Model/Navn": "model",
+		"Grund/Farve":                 "color",
+	}
+	for _, c := range []struct {
+		name   string
+		record string
+		want   map[string]string
+		err    bool
+	}{
+		{"empty record", "<Statistik></Statistik>", map[string]string{}, false},
+		{"nested paths", `<ns:Statistik xmlns:ns="x"><ns:RegistreringNummerNummer>AB12345</ns:RegistreringNummerNummer>
+			<ns:Grund><ns:Betegnelse><ns:Maerke>AUDI</ns:Maerke><ns:Model><ns:Navn>A 6</ns:Navn></ns:Model></ns:Betegnelse></ns:Grund></ns:Statistik>`,
+			map[string]string{"plate": "AB12345", "make": "AUDI", "model": "A 6"}, false},
+		{"first occurrence", "<Statistik><RegistreringNummerNummer>AB12345</RegistreringNummerNummer><RegistreringNummerNummer>CD67890</RegistreringNummerNummer></Statistik>",
+			map[string]string{"plate": "AB12345"}, false},
+		{"unmapped and misplaced elements", "<Statistik><Maerke>AUDI</Maerke><Grund><Andet>x</Andet></Grund></Statistik>",
+			map[string]string{}, false},
+		{"empty element", "<Statistik><Grund><Farve/></Grund></Statistik>", map[string]string{"color": ""}, false},
+		{"entities and CDATA", "<Statistik><Grund><Betegnelse><Maerke>A&amp;<![CDATA[<B>]]></Maerke></Betegnelse></Grund></Statistik>",
+			map[string]string{"make": "A&<B>"}, false},
+		{"truncated", "<Statistik><RegistreringNummerNummer>AB12345", nil, true},
+	} {
+		decoder := xml.NewDecoder(strings.NewReader(c.record))
+		if _, err := decoder.RawToken(); err != nil {
+			t.Fatal(err)
+		}
+		values, err := scanMapped(decoder.RawToken, mapping)
+		if (err != nil) != c.err {
+			t.Errorf("%s: got error %v, want an error: %v", c.name, err, c.err)
+			continue
+		}
+		if c.err {
+			continue
+		}
+		if fmt.Sprint(values) != fmt.Sprint(c.want) {
+			t.Errorf("%s: got %v, want %v", c.name, values, c.want)
+		}
+	}
+}
+
+func TestRecordingReaderCap(t *testing.T) {
+	for _, c := range []struct {
+		name      string
+		size      int
+		byByte    bool
+		recording bool
+		want      int
+	}{
+		{"empty", 0, false, true, 0},
+		{"below the cap", maxRecordBytes - 1, false, true, maxRecordBytes - 1},
+		{"at the cap", maxRecordBytes, false, true, maxRecordBytes},
+		{"above the cap", 3 * maxRecordBytes, false, true, maxRecordBytes},
+		{"above the cap by byte", maxRecordBytes + 1, true, true, maxRecordBytes},
+		{"below the cap by byte", 100, true, true, 100},
+		{"not recording", 100, false, false, 0},
+		{"not recording by byte", 100, true, false, 0},
+	} {
+		input := strings.Repeat("x", c.size)
+		r := &recordingReader{r: bufio.NewReader(strings.NewReader(input)), recording: c.recording}
+		var read []byte
+		var err error
+		if c.byByte {
+			for {
+				var b byte
+				if b, err = r.ReadByte(); err != nil {
+					break
+				}
+				read = append(read, b)
+			}
+		} else {
+			// Small reads, so the cap is reached part way through one of them
+			buf := make([]byte, 1000)
+			for {
+				var n int
+				n, err = r.Read(buf)
+				read = append(read, buf[:n]...)
+				if err != nil {
+					break
+				}
+			}
+		}
+		if err != io.EOF {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		// The cap only limits what is kept, not what is read
+		if string(read) != input {
+			t.Errorf("%s: read %d bytes, want %d", c.name, len(read), c.size)
+		}
+		if len(r.buf) != c.want || string(r.buf) != input[:c.want] {
+			t.Errorf("%s: kept %d bytes, want %d", c.name, len(r.buf), c.want)
+		}
+	}
+}